@@ -1,10 +1,9 @@
 package cmd
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"os"
 	"os/exec"
 )
@@ -14,12 +13,14 @@ var auditCmd = &cobra.Command{
 	Use:   "audit",
 	Short: "Invoke the audit agent",
 	Long: `Invokes the audit agent.
-Any parameters after this command will be passed to auditbeat.`,
+Any parameters after this command will be passed to auditbeat.
+Use --insecure as the first parameter to skip the integrity check
+of the auditbeat binary (see 'morio integrity').`,
 	Args: cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		// Get path to auditbeat from config (and make sure it is set)
-		EnsureBeatPath("auditbeat", "audit")
-		path := viper.GetString("agents.audit")
+		// Find auditbeat, and make sure it is the binary we recorded
+		path, args := AgentCommand(cmd, "audit", args)
+		EnsureAgentSocketFolder()
 
 		// Pass all arguments (after audit) to the auditbeat binary
 		// but also add the location of the Morio-specific config
@@ -44,12 +45,14 @@ var logsCmd = &cobra.Command{
 	Use:   "logs",
 	Short: "Invoke the logs agent",
 	Long: `Invokes the logs agent.
-Any parameters after this command will be passed to filebeat.`,
+Any parameters after this command will be passed to filebeat.
+Use --insecure as the first parameter to skip the integrity check
+of the filebeat binary (see 'morio integrity').`,
 	Args: cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		// Get path to filebeat from config (and make sure it is set)
-		EnsureBeatPath("filebeat", "logs")
-		path := viper.GetString("agents.logs")
+		// Find filebeat, and make sure it is the binary we recorded
+		path, args := AgentCommand(cmd, "logs", args)
+		EnsureAgentSocketFolder()
 
 		// Pass all arguments (after logs) to the filebeat binary
 		// but also add the location of the Morio-specific config
@@ -74,12 +77,14 @@ var metricsCmd = &cobra.Command{
 	Use:   "metrics",
 	Short: "Invoke the metrics agent",
 	Long: `Invokes the metrics agent.
-Any parameters after this command will be passed to metricbeat.`,
+Any parameters after this command will be passed to metricbeat.
+Use --insecure as the first parameter to skip the integrity check
+of the metricbeat binary (see 'morio integrity').`,
 	Args: cobra.ArbitraryArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		// Get path to metricbeat from config (and make sure it is set)
-		EnsureBeatPath("metricbeat", "metrics")
-		path := viper.GetString("agents.metrics")
+		// Find metricbeat, and make sure it is the binary we recorded
+		path, args := AgentCommand(cmd, "metrics", args)
+		EnsureAgentSocketFolder()
 
 		// Pass all arguments (after logs) to the metricbeat binary
 		// but also add the location of the Morio-specific config
@@ -111,33 +116,32 @@ func init() {
 	RootCmd.AddCommand(metricsCmd)
 }
 
-// Makes sure that the path to the agent is set in the config
-func EnsureBeatPath(beat string, dataType string) {
-	key := "agents." + dataType
-	if !viper.IsSet(key) {
-		// Not set, prompt the user for the path
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print("Please provide the path to " + beat + ": ")
-		path, _ := reader.ReadString('\n')
-
-		// Trim newline characters from the input
-		path = path[:len(path)-1]
-
-		// Set the value in Viper
-		viper.Set(key, path)
-
-		// Save the updated configuration to the file
-		if err := viper.WriteConfig(); err != nil {
-			if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-				// If no config file exists, create one
-				if err := viper.SafeWriteConfig(); err != nil {
-					fmt.Println("Failed to create config file:", err)
-					os.Exit(1)
-				}
-			} else {
-				fmt.Println("Failed to write to config file:", err)
-				os.Exit(1)
-			}
+// Returns the verified binary of an agent, and the arguments to pass it
+// Use --insecure as the first argument to skip the verification.
+func AgentCommand(cmd *cobra.Command, agent string, args []string) (string, []string) {
+	// Our help does not need the agent, the help of the agent is a bonus
+	if len(args) > 0 && (args[0] == "--help" || args[0] == "-h") {
+		cmd.Help()
+		path, err := VerifiedBeatPath(agent, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nUnable to show the help of the %s agent: %v\n", agent, err)
+			os.Exit(0)
 		}
+		fmt.Println()
+		return path, args
 	}
+	insecure := len(args) > 0 && args[0] == "--insecure"
+	if insecure {
+		args = args[1:]
+	}
+	path, err := VerifiedBeatPath(agent, insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if errors.Is(err, errUnverifiedBeat) {
+			fmt.Fprintln(os.Stderr, "Use --insecure as the first argument to run it anyway.")
+		}
+		os.Exit(1)
+	}
+
+	return path, args
 }
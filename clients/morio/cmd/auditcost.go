@@ -0,0 +1,486 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// morio audit rules cost
+var auditRulesCostCmd = &cobra.Command{
+	Use:   "cost",
+	Short: "Estimate the event volume of the audit rules",
+	Long: `Estimates the event volume of the rendered audit rules.
+
+Each rule in the effective rule set is classified as high, medium, or low
+volume, based on what it matches: syscalls that run all the time, file
+watches on busy paths, and missing -F filters all make a rule expensive.
+
+Use --sample to replay a recorded audit log against the rules, and
+estimate the events per second each rule would generate on this host.
+To record a sample, briefly log the syscalls your rules use, and save
+them with ausearch. Remove the rule again right away:
+
+  auditctl -a always,exit -F arch=b64 -S execve,openat,connect -k morio-sample
+  sleep 60
+  auditctl -d always,exit -F arch=b64 -S execve,openat,connect -k morio-sample
+  ausearch -k morio-sample -i > sample.log
+
+Recording adds load to the host, and a busy host can lose audit events
+while it runs. Record on a staging host with similar traffic if you can.
+Do not record with -S all on a production host: logging every syscall
+can slow it down to the point where it stops responding.
+
+The replay is an estimate: only common fields are evaluated, and rules
+with filters on other fields are assumed to match.`,
+	Example: `  morio audit rules cost
+  morio audit rules cost --sample sample.log`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rules, _ := LoadAuditRules()
+		rules = EffectiveAuditRules(rules)
+		var sample *AuditSample
+		if auditCostSample != "" {
+			loaded, err := LoadAuditSample(auditCostSample)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			sample = &loaded
+		}
+		ShowAuditRuleCosts(rules, sample)
+	},
+}
+
+var auditCostSample string
+
+func init() {
+	auditRulesCmd.AddCommand(auditRulesCostCmd)
+	auditRulesCostCmd.Flags().StringVar(&auditCostSample, "sample", "", "A recorded audit log to replay against the rules")
+}
+
+// The expected event volume of a rule, and why
+type AuditRuleCost struct {
+	Rule    AuditRule
+	Level   string // high, medium, or low
+	Reasons []string
+}
+
+var auditCostLevels = []string{"high", "medium", "low"}
+
+// Syscalls that most processes make all the time
+var hotSyscalls = []string{
+	"read", "write", "open", "openat", "openat2", "close", "stat", "fstat", "lstat", "newfstatat", "statx",
+	"mmap", "munmap", "mprotect", "brk", "poll", "ppoll", "select", "pselect6", "epoll_wait", "epoll_pwait",
+	"futex", "nanosleep", "clock_nanosleep", "recvfrom", "recvmsg", "sendto", "sendmsg", "access", "faccessat",
+	"readlink", "readlinkat", "getdents", "getdents64", "lseek", "ioctl", "fcntl", "getpid", "gettid",
+}
+
+// Syscalls that run for every process, or every connection
+var warmSyscalls = []string{"execve", "execveat", "fork", "vfork", "clone", "clone3", "exit", "exit_group", "connect", "accept", "accept4", "socket"}
+
+// Paths that see a lot of file activity
+var hotPaths = []string{"/", "/tmp", "/var/tmp", "/dev/shm", "/run", "/var/run", "/proc", "/sys", "/dev", "/var/log", "/var/cache", "/var/lib", "/home", "/usr", "/usr/lib", "/lib"}
+
+// Filters that narrow a rule down to a small set of events
+var narrowFields = []string{"auid", "uid", "euid", "gid", "egid", "pid", "ppid", "exe", "dir", "path", "success", "exit", "perm", "a0", "a1", "a2", "a3"}
+
+// Classifies a rule by its expected event volume
+func AuditRuleVolume(rule AuditRule) AuditRuleCost {
+	cost := AuditRuleCost{Rule: rule, Level: "low"}
+	raise := func(level string, reason string) {
+		if indexOf(auditCostLevels, level) < indexOf(auditCostLevels, cost.Level) {
+			cost.Level = level
+		}
+		cost.Reasons = append(cost.Reasons, level+": "+reason)
+	}
+
+	switch rule.Kind {
+	case "watch":
+		path := strings.TrimSuffix(rule.Path, "/")
+		if path == "" {
+			path = "/"
+		}
+		if contains(hotPaths, path) {
+			raise("high", "watches "+rule.Path+", which sees constant file activity")
+		} else {
+			for _, hot := range []string{"/tmp/", "/var/tmp/", "/dev/shm/", "/proc/", "/var/log/", "/var/cache/"} {
+				if strings.HasPrefix(path+"/", hot) {
+					raise("medium", "watches a path below "+strings.TrimSuffix(hot, "/")+", which sees a lot of file activity")
+					break
+				}
+			}
+		}
+		if rule.Perms == "" {
+			raise("medium", "watch has no -p, so it matches reads, writes, executes, and attribute changes")
+		} else if strings.Contains(rule.Perms, "r") {
+			raise("medium", "watch includes r (read) permission, reads are far more frequent than writes")
+		}
+	case "syscall":
+		if rule.Action == "never" || rule.List == "exclude" {
+			cost.Reasons = append(cost.Reasons, "low: reduces the event volume")
+			return cost
+		}
+		switch rule.List {
+		case "task":
+			raise("medium", "rule on the task list matches every process creation")
+		case "user":
+			raise("medium", "rule on the user list matches all user space messages")
+		}
+		if rule.List != "exit" {
+			break
+		}
+		narrowed := false
+		arch := false
+		for _, field := range rule.Fields {
+			name := auditFieldRegex.FindStringSubmatch(field)[1]
+			if name == "arch" {
+				arch = true
+			}
+			if contains(narrowFields, name) {
+				narrowed = true
+			}
+		}
+		if len(rule.Syscalls) == 0 || contains(rule.Syscalls, "all") {
+			raise("high", "matches all syscalls")
+		}
+		for _, syscall := range rule.Syscalls {
+			if contains(hotSyscalls, syscall) {
+				if narrowed {
+					raise("medium", syscall+" runs constantly, but the rule has -F filters")
+				} else {
+					raise("high", syscall+" runs constantly, and the rule has no -F filters to narrow it down")
+				}
+			} else if contains(warmSyscalls, syscall) {
+				raise("medium", syscall+" runs on every process start or connection")
+			}
+		}
+		if !narrowed && len(rule.Syscalls) > 0 && cost.Level == "low" {
+			raise("medium", "rule has no -F filters (like auid, dir, or success) to narrow it down")
+		}
+		if !arch {
+			cost.Reasons = append(cost.Reasons, "note: rule has no -F arch filter, so syscalls of the other architecture are missed")
+		}
+	}
+
+	return cost
+}
+
+// A recorded audit log, grouped into events
+type AuditSample struct {
+	Events []AuditEvent
+	// Time between the first and the last event
+	Duration time.Duration
+}
+
+// An audit event, with the fields of its SYSCALL record and the paths it touched
+type AuditEvent struct {
+	Fields map[string]string
+	Paths  []string
+}
+
+var (
+	auditRecordHeader = regexp.MustCompile(`msg=audit\(([^)]+):(\d+)\)\s*:?`)
+	auditRecordField  = regexp.MustCompile(`(\w+)=("[^"]*"|\S+)`)
+)
+
+// Reads a raw or interpreted (ausearch -i) audit log
+func LoadAuditSample(path string) (AuditSample, error) {
+	var sample AuditSample
+	file, err := os.Open(path)
+	if err != nil {
+		return sample, err
+	}
+	defer file.Close()
+
+	events := make(map[string]*AuditEvent)
+	var order []string
+	var first, last time.Time
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		header := auditRecordHeader.FindStringSubmatchIndex(line)
+		if header == nil {
+			continue
+		}
+		stamp := line[header[2]:header[3]]
+		serial := line[header[4]:header[5]]
+		recordType := strings.TrimPrefix(strings.Fields(line)[0], "type=")
+		if recordType != "SYSCALL" && recordType != "PATH" {
+			continue
+		}
+		if when, ok := parseAuditTime(stamp); ok {
+			if first.IsZero() || when.Before(first) {
+				first = when
+			}
+			if when.After(last) {
+				last = when
+			}
+		}
+		event, ok := events[serial]
+		if !ok {
+			event = &AuditEvent{Fields: map[string]string{}}
+			events[serial] = event
+			order = append(order, serial)
+		}
+		for _, match := range auditRecordField.FindAllStringSubmatch(line[header[1]:], -1) {
+			value := strings.Trim(match[2], `"`)
+			if recordType == "PATH" {
+				if match[1] == "name" {
+					event.Paths = append(event.Paths, value)
+				}
+			} else {
+				event.Fields[match[1]] = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return sample, err
+	}
+
+	for _, serial := range order {
+		if len(events[serial].Fields) > 0 {
+			sample.Events = append(sample.Events, *events[serial])
+		}
+	}
+	if len(sample.Events) == 0 {
+		return sample, fmt.Errorf("no syscall events found in %s", path)
+	}
+	sample.Duration = last.Sub(first)
+	if sample.Duration < time.Second {
+		sample.Duration = time.Second
+	}
+
+	return sample, nil
+}
+
+// Timestamps are epoch seconds in raw logs, and a date in interpreted logs
+func parseAuditTime(stamp string) (time.Time, bool) {
+	if seconds, err := strconv.ParseFloat(stamp, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	}
+	when, err := time.Parse("01/02/2006 15:04:05.000", stamp)
+
+	return when, err == nil
+}
+
+// Syscall numbers of common syscalls on x86_64, for raw audit logs
+var x86_64Syscalls = map[string]string{
+	"0": "read", "1": "write", "2": "open", "3": "close", "4": "stat", "5": "fstat", "6": "lstat", "9": "mmap",
+	"21": "access", "41": "socket", "42": "connect", "43": "accept", "56": "clone", "57": "fork", "58": "vfork",
+	"59": "execve", "60": "exit", "62": "kill", "76": "truncate", "77": "ftruncate", "82": "rename", "83": "mkdir",
+	"84": "rmdir", "85": "creat", "86": "link", "87": "unlink", "88": "symlink", "90": "chmod", "91": "fchmod",
+	"92": "chown", "93": "fchown", "94": "lchown", "101": "ptrace", "105": "setuid", "106": "setgid",
+	"165": "mount", "166": "umount2", "175": "init_module", "176": "delete_module", "188": "setxattr",
+	"197": "removexattr", "231": "exit_group", "257": "openat", "258": "mkdirat", "260": "fchownat",
+	"262": "newfstatat", "263": "unlinkat", "264": "renameat", "265": "linkat", "266": "symlinkat",
+	"268": "fchmodat", "288": "accept4", "313": "finit_module", "316": "renameat2", "322": "execveat",
+	"332": "statx", "437": "openat2",
+}
+
+// Syscalls that a watch with the given permission matches
+var watchSyscalls = map[byte][]string{
+	'r': {"open", "openat", "openat2", "read", "readlink", "readlinkat"},
+	'w': {"open", "openat", "openat2", "creat", "write", "truncate", "ftruncate", "rename", "renameat", "renameat2",
+		"unlink", "unlinkat", "mkdir", "mkdirat", "rmdir", "link", "linkat", "symlink", "symlinkat"},
+	'x': {"execve", "execveat"},
+	'a': {"chmod", "fchmod", "fchmodat", "chown", "fchown", "fchownat", "lchown", "setxattr", "removexattr"},
+}
+
+func (event AuditEvent) Syscall() string {
+	syscall := event.Fields["syscall"]
+	if name, ok := x86_64Syscalls[syscall]; ok && event.Is64Bit() {
+		return name
+	}
+
+	return syscall
+}
+
+func (event AuditEvent) Is64Bit() bool {
+	arch := event.Fields["arch"]
+	return arch == "x86_64" || arch == "c000003e" || arch == "aarch64" || arch == "c00000b7"
+}
+
+// Returns true if a rule would log the event
+// Filters on fields that are not in the event are assumed to match.
+func (event AuditEvent) MatchesRule(rule AuditRule) bool {
+	syscall := event.Syscall()
+	switch rule.Kind {
+	case "watch":
+		perms := rule.Perms
+		if perms == "" {
+			perms = "rwxa"
+		}
+		matched := false
+		for i := 0; i < len(perms); i++ {
+			matched = matched || contains(watchSyscalls[perms[i]], syscall)
+		}
+		return matched && event.touches(rule.Path, true)
+	case "syscall":
+		if rule.List != "exit" {
+			return false
+		}
+		if len(rule.Syscalls) > 0 && !contains(rule.Syscalls, "all") && !contains(rule.Syscalls, syscall) {
+			return false
+		}
+		for _, field := range rule.Fields {
+			if !event.matchesField(field) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// Returns true if the event touched the path, or anything below it
+func (event AuditEvent) touches(path string, below bool) bool {
+	for _, name := range event.Paths {
+		if name == path || (below && strings.HasPrefix(name, strings.TrimSuffix(path, "/")+"/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (event AuditEvent) matchesField(field string) bool {
+	match := auditFieldRegex.FindStringSubmatch(field)
+	name, operator, expected := match[1], match[2], match[3]
+	switch name {
+	case "arch":
+		is64 := event.Is64Bit()
+		want64 := expected == "b64"
+		return (operator == "=") == (is64 == want64)
+	case "dir":
+		return event.touches(expected, true) == (operator == "=")
+	case "path":
+		return event.touches(expected, false) == (operator == "=")
+	}
+	actual, ok := event.Fields[name]
+	if !ok {
+		return true
+	}
+	actual = normalizeAuditValue(actual)
+	expected = normalizeAuditValue(expected)
+	a, errA := strconv.ParseInt(actual, 10, 64)
+	b, errB := strconv.ParseInt(expected, 10, 64)
+	if errA != nil || errB != nil {
+		switch operator {
+		case "=":
+			return actual == expected
+		case "!=":
+			return actual != expected
+		}
+		return true
+	}
+	switch operator {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case ">":
+		return a > b
+	case "<=":
+		return a <= b
+	case ">=":
+		return a >= b
+	case "&=":
+		return a&b == b
+	}
+
+	return a&b != 0
+}
+
+// The unset uid is written in different ways
+func normalizeAuditValue(value string) string {
+	switch value {
+	case "unset", "-1", "4294967295":
+		return "4294967295"
+	case "yes":
+		return "1"
+	case "no":
+		return "0"
+	}
+
+	return value
+}
+
+// Replays the sample against the rules, and returns the events per rule
+// As in the kernel, the first rule that matches an event decides.
+func ReplayAuditSample(rules []AuditRule, sample AuditSample) []int {
+	counts := make([]int, len(rules))
+	for _, event := range sample.Events {
+		for i, rule := range rules {
+			if event.MatchesRule(rule) {
+				if rule.Action != "never" {
+					counts[i]++
+				}
+				break
+			}
+		}
+	}
+
+	return counts
+}
+
+func ShowAuditRuleCosts(rules []AuditRule, sample *AuditSample) {
+	if len(rules) == 0 {
+		fmt.Println("No audit rules found. Run 'morio template' to render them.")
+		return
+	}
+	var counts []int
+	if sample != nil {
+		counts = ReplayAuditSample(rules, *sample)
+	}
+
+	costs := make([]AuditRuleCost, len(rules))
+	for i, rule := range rules {
+		costs[i] = AuditRuleVolume(rule)
+	}
+	indexes := make([]int, len(rules))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return indexOf(auditCostLevels, costs[indexes[i]].Level) < indexOf(auditCostLevels, costs[indexes[j]].Level)
+	})
+
+	total := 0
+	for _, i := range indexes {
+		cost := costs[i]
+		rate := ""
+		if sample != nil {
+			total += counts[i]
+			rate = fmt.Sprintf("  ~%.1f events/s", float64(counts[i])/sample.Duration.Seconds())
+		}
+		fmt.Printf("%-6s %s%s\n", strings.ToUpper(cost.Level), cost.Rule.Location(), rate)
+		fmt.Println("       " + cost.Rule.Text)
+		for _, reason := range cost.Reasons {
+			fmt.Println("         - " + reason)
+		}
+	}
+	if sample != nil {
+		fmt.Printf("\nEstimated total: ~%.1f events/s (%d of %d events in a %s sample)\n",
+			float64(total)/sample.Duration.Seconds(), total, len(sample.Events), sample.Duration.Round(time.Second))
+	}
+}
+
+func indexOf(list []string, value string) int {
+	for i, item := range list {
+		if item == value {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,443 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// morio audit rules
+var auditRulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "Manage the audit rules",
+	Long: `Inspects the audit rules that 'morio template' renders from
+/etc/morio/audit/rule-templates.d into /etc/morio/audit/rules.d.
+
+Rule files are loaded in lexical order, and use the auditctl syntax
+that auditbeat supports: file watches (-w) and syscall rules (-a).`,
+}
+
+// morio audit rules list
+var auditRulesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the audit rule files",
+	Long:  `Lists the rendered audit rule files in load order, with the number of rules in each.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		files := AuditRuleFiles()
+		if len(files) == 0 {
+			fmt.Println("No audit rule files found. Run 'morio template' to render them.")
+			return
+		}
+		for _, file := range files {
+			rules, diagnostics := ParseAuditRuleFile(file)
+			watches, syscalls := 0, 0
+			for _, rule := range rules {
+				switch rule.Kind {
+				case "watch":
+					watches++
+				case "syscall":
+					syscalls++
+				}
+			}
+			note := ""
+			if len(diagnostics) > 0 {
+				note = fmt.Sprintf(", %d problems", len(diagnostics))
+			}
+			fmt.Printf("%-50s %3d watches, %3d syscall rules%s\n", file, watches, syscalls, note)
+		}
+	},
+}
+
+// morio audit rules lint
+var auditRulesLintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Check the audit rules for mistakes",
+	Long: `Checks the rendered audit rules for mistakes.
+
+This flags:
+  - Syntax errors, and options that auditbeat does not support
+  - Paths that are watched more than once
+  - Syscall rules that are duplicated, or that conflict with each other
+    (the same syscalls and filters, with a different action). Rules
+    added with -A are loaded before the rules added with -a.
+  - Syscall rules that match all syscalls, or too many syscall rules
+
+This command exits with status 1 if any errors are found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rules, diagnostics := LoadAuditRules()
+		diagnostics = append(diagnostics, LintAuditRules(rules)...)
+		if ShowLintDiagnostics(diagnostics) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// morio audit rules show
+var auditRulesShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show the effective audit rules",
+	Long: `Shows the effective audit rule set, as it will be loaded.
+
+All rule files are merged in load order. Rules before a -D (delete all)
+are dropped, as are exact duplicates and lines that do not parse.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rules, _ := LoadAuditRules()
+		file := ""
+		for _, rule := range EffectiveAuditRules(rules) {
+			if rule.File != file {
+				if file != "" {
+					fmt.Println()
+				}
+				fmt.Println("# " + rule.File)
+				file = rule.File
+			}
+			fmt.Println(rule.Text)
+		}
+		if file == "" {
+			fmt.Println("# No audit rules")
+		}
+	},
+}
+
+func init() {
+	auditCmd.AddCommand(auditRulesCmd)
+	auditRulesCmd.AddCommand(auditRulesListCmd)
+	auditRulesCmd.AddCommand(auditRulesLintCmd)
+	auditRulesCmd.AddCommand(auditRulesShowCmd)
+}
+
+// A single audit rule, as parsed from a rules file
+type AuditRule struct {
+	File string
+	Line int
+	Text string
+	// watch, syscall, or delete-all
+	Kind string
+	// For watches
+	Path  string
+	Perms string
+	// For syscall rules
+	Action string
+	List   string
+	// Added with -A, so loaded before the rules added with -a
+	Prepend  bool
+	Syscalls []string
+	Fields   []string
+	Keys     []string
+}
+
+// Above this many syscall rules, every syscall gets noticeably slower
+const maxSyscallRules int = 50
+
+var (
+	auditActions    = []string{"always", "never"}
+	auditLists      = []string{"task", "exit", "user", "exclude", "filesystem", "io_uring"}
+	auditFieldRegex = regexp.MustCompile(`^([a-z0-9_]+)(=|!=|<=|>=|<|>|&=|&)(.+)$`)
+	auditNameRegex  = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// Options of auditctl that auditbeat does not support in rule files
+var unsupportedAuditOptions = map[string]string{
+	"-b":                   "backlog_limit in the auditd module config",
+	"-e":                   "the auditd module config",
+	"-f":                   "failure_mode in the auditd module config",
+	"-r":                   "rate_limit in the auditd module config",
+	"--backlog_wait_time":  "backlog_wait_time in the auditd module config",
+	"--loginuid-immutable": "the auditd configuration",
+	"-i":                   "",
+	"-c":                   "",
+	"-R":                   "",
+	"-l":                   "",
+	"-s":                   "",
+}
+
+// Returns the rendered audit rule files, in load order
+func AuditRuleFiles() []string {
+	var files []string
+	folder := GetConfigPath("audit/rules.d")
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return files
+	}
+	for _, entry := range entries {
+		suffix := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (suffix == ".yaml" || suffix == ".rules" || suffix == ".conf") {
+			files = append(files, filepath.Join(folder, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// Parses all rendered audit rule files, in load order
+func LoadAuditRules() ([]AuditRule, []LintDiagnostic) {
+	var rules []AuditRule
+	var diagnostics []LintDiagnostic
+	for _, file := range AuditRuleFiles() {
+		fileRules, fileDiagnostics := ParseAuditRuleFile(file)
+		rules = append(rules, fileRules...)
+		diagnostics = append(diagnostics, fileDiagnostics...)
+	}
+
+	return rules, diagnostics
+}
+
+// Parses an audit rules file
+// Lines that do not parse are reported, and left out of the rules.
+func ParseAuditRuleFile(path string) ([]AuditRule, []LintDiagnostic) {
+	var rules []AuditRule
+	var diagnostics []LintDiagnostic
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rules, append(diagnostics, LintDiagnostic{path, 0, "error", err.Error()})
+	}
+	for index, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseAuditRule(line)
+		if err != nil {
+			diagnostics = append(diagnostics, LintDiagnostic{path, index + 1, "error", err.Error()})
+			continue
+		}
+		rule.File = path
+		rule.Line = index + 1
+		rules = append(rules, rule)
+	}
+
+	return rules, diagnostics
+}
+
+// Parses a single line in auditctl syntax
+func ParseAuditRule(text string) (AuditRule, error) {
+	rule := AuditRule{Text: text}
+	words := strings.Fields(text)
+	for i := 0; i < len(words); i++ {
+		option := words[i]
+		if option == "-D" {
+			rule.Kind = "delete-all"
+			continue
+		}
+		if use, ok := unsupportedAuditOptions[option]; ok {
+			if use != "" {
+				return rule, fmt.Errorf("option %s is not supported by auditbeat, use %s instead", option, use)
+			}
+			return rule, fmt.Errorf("option %s is not supported by auditbeat", option)
+		}
+		if !strings.HasPrefix(option, "-") {
+			return rule, fmt.Errorf("unexpected %s, expected an option", option)
+		}
+		if i+1 == len(words) {
+			return rule, fmt.Errorf("option %s needs a value", option)
+		}
+		i++
+		value := strings.Trim(words[i], `"`)
+		switch option {
+		case "-w":
+			rule.Kind = "watch"
+			rule.Path = value
+		case "-W":
+			return rule, fmt.Errorf("removing watches with -W is not supported by auditbeat")
+		case "-p":
+			if strings.Trim(value, "rwxa") != "" {
+				return rule, fmt.Errorf("invalid permissions %s, use a combination of r, w, x, and a", value)
+			}
+			// So that -p wa and -p aw are the same
+			perms := strings.Split(value, "")
+			sort.Strings(perms)
+			rule.Perms = strings.Join(perms, "")
+		case "-a", "-A":
+			action, list, ok := strings.Cut(value, ",")
+			if !ok {
+				return rule, fmt.Errorf("invalid rule %s, use action,list (like always,exit)", value)
+			}
+			// auditctl accepts both orders
+			if contains(auditLists, action) {
+				action, list = list, action
+			}
+			if !contains(auditActions, action) {
+				return rule, fmt.Errorf("invalid action %s, use always or never", action)
+			}
+			if !contains(auditLists, list) {
+				return rule, fmt.Errorf("invalid list %s, use one of %s", list, strings.Join(auditLists, ", "))
+			}
+			rule.Kind = "syscall"
+			rule.Action = action
+			rule.List = list
+			rule.Prepend = option == "-A"
+		case "-d":
+			return rule, fmt.Errorf("deleting rules with -d is not supported by auditbeat")
+		case "-S":
+			for _, syscall := range strings.Split(value, ",") {
+				if !auditNameRegex.MatchString(syscall) {
+					return rule, fmt.Errorf("invalid syscall %s", syscall)
+				}
+				rule.Syscalls = append(rule.Syscalls, syscall)
+			}
+		case "-F", "-C":
+			match := auditFieldRegex.FindStringSubmatch(value)
+			if match == nil {
+				return rule, fmt.Errorf("invalid field %s, use name=value (or another operator)", value)
+			}
+			if match[1] == "key" {
+				rule.Keys = append(rule.Keys, match[3])
+			} else {
+				rule.Fields = append(rule.Fields, value)
+			}
+		case "-k":
+			rule.Keys = append(rule.Keys, value)
+		default:
+			return rule, fmt.Errorf("unknown option %s", option)
+		}
+	}
+
+	switch rule.Kind {
+	case "":
+		return rule, fmt.Errorf("rule has no -w or -a option")
+	case "watch":
+		if rule.Action != "" || len(rule.Syscalls) > 0 || len(rule.Fields) > 0 {
+			return rule, fmt.Errorf("a watch (-w) cannot be combined with -a, -S, or -F")
+		}
+	case "syscall":
+		if rule.Perms != "" {
+			return rule, fmt.Errorf("permissions (-p) can only be used with a watch (-w)")
+		}
+		if len(rule.Syscalls) > 0 && rule.List != "exit" {
+			return rule, fmt.Errorf("syscalls (-S) can only be used on the exit list, not %s", rule.List)
+		}
+	case "delete-all":
+		if len(words) > 1 {
+			return rule, fmt.Errorf("-D cannot be combined with other options")
+		}
+	}
+
+	return rule, nil
+}
+
+// What a syscall rule matches, regardless of its action or keys
+func (rule AuditRule) Matcher() string {
+	syscalls := append([]string{}, rule.Syscalls...)
+	fields := append([]string{}, rule.Fields...)
+	sort.Strings(syscalls)
+	sort.Strings(fields)
+
+	return rule.List + " -S " + strings.Join(syscalls, ",") + " -F " + strings.Join(fields, " -F ")
+}
+
+func (rule AuditRule) Location() string {
+	return fmt.Sprintf("%s:%d", rule.File, rule.Line)
+}
+
+// Checks the rules for duplicates, conflicts, and excessive syscall rules
+func LintAuditRules(rules []AuditRule) []LintDiagnostic {
+	var diagnostics []LintDiagnostic
+	add := func(rule AuditRule, severity string, message string) {
+		diagnostics = append(diagnostics, LintDiagnostic{rule.File, rule.Line, severity, message})
+	}
+
+	watches := make(map[string]AuditRule)
+	matchers := make(map[string]AuditRule)
+	syscallRules := 0
+	for _, rule := range auditLoadOrder(rules) {
+		switch rule.Kind {
+		case "delete-all":
+			add(rule, "warning", "-D removes all rules loaded before it")
+			watches = make(map[string]AuditRule)
+			matchers = make(map[string]AuditRule)
+			syscallRules = 0
+		case "watch":
+			if first, ok := watches[rule.Path]; ok {
+				add(rule, "warning", "path "+rule.Path+" is already watched at "+first.Location())
+			} else {
+				watches[rule.Path] = rule
+			}
+		case "syscall":
+			if rule.List == "exit" {
+				syscallRules++
+				if len(rule.Syscalls) == 0 || contains(rule.Syscalls, "all") {
+					add(rule, "warning", "rule matches all syscalls, which is very expensive")
+				}
+			}
+			first, ok := matchers[rule.Matcher()]
+			switch {
+			case !ok:
+				matchers[rule.Matcher()] = rule
+			case first.Action != rule.Action:
+				add(rule, "error", "rule conflicts with the "+first.Action+" rule at "+first.Location()+", which is loaded first and wins")
+			default:
+				add(rule, "warning", "rule is a duplicate of the rule at "+first.Location())
+			}
+		}
+	}
+	if syscallRules > maxSyscallRules {
+		last := rules[len(rules)-1]
+		add(last, "warning", fmt.Sprintf("%d syscall rules are loaded, every syscall is checked against all of them (keep it below %d)", syscallRules, maxSyscallRules))
+	}
+
+	return diagnostics
+}
+
+// Returns the rules as they will be loaded
+// Rules before the last -D are dropped, as are exact duplicates.
+func EffectiveAuditRules(rules []AuditRule) []AuditRule {
+	var effective []AuditRule
+	seen := make(map[string]bool)
+	for _, rule := range auditLoadOrder(rules) {
+		if rule.Kind == "delete-all" {
+			effective = nil
+			seen = make(map[string]bool)
+			continue
+		}
+		signature := auditRuleSignature(rule)
+		if seen[signature] {
+			continue
+		}
+		seen[signature] = true
+		effective = append(effective, rule)
+	}
+
+	return effective
+}
+
+// Returns the rules in the order the kernel sees them
+// A rule added with -A goes to the front of its list, so the -A rules
+// come first, last one first, followed by the rest. A -D starts over.
+func auditLoadOrder(rules []AuditRule) []AuditRule {
+	var ordered, prepended, appended []AuditRule
+	flush := func() {
+		for i := len(prepended) - 1; i >= 0; i-- {
+			ordered = append(ordered, prepended[i])
+		}
+		ordered = append(ordered, appended...)
+		prepended, appended = nil, nil
+	}
+	for _, rule := range rules {
+		switch {
+		case rule.Kind == "delete-all":
+			flush()
+			ordered = append(ordered, rule)
+		case rule.Prepend:
+			prepended = append(prepended, rule)
+		default:
+			appended = append(appended, rule)
+		}
+	}
+	flush()
+
+	return ordered
+}
+
+// What makes a rule unique, regardless of its keys
+func auditRuleSignature(rule AuditRule) string {
+	if rule.Kind == "syscall" {
+		return rule.Action + "|" + rule.Matcher()
+	}
+
+	return rule.Path + "|" + rule.Perms
+}
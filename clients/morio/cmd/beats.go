@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The agents that Morio manages
+var Agents = []string{"audit", "logs", "metrics"}
+
+// The beat versions we support, unless morio.yaml or a template says otherwise
+const DefaultBeatVersions string = ">=8.0.0"
+
+// Where beats end up when they are not in the PATH
+// {beat} is replaced with the name of the beat
+// FIXME: Make this platform agnostic
+var beatLocations = []string{
+	"/usr/share/{beat}/bin/{beat}",
+	"/usr/bin/{beat}",
+	"/usr/local/bin/{beat}",
+	"/opt/{beat}/{beat}",
+	"/opt/homebrew/bin/{beat}",
+}
+
+// What we know about the binary of an agent
+type BeatBinary struct {
+	Agent string
+	Beat  string
+	Path  string
+	// Where we found the binary: morio.yaml, PATH, or a common location
+	Source   string
+	Version  string
+	Requires []VersionRequirement
+	Problems []string
+}
+
+// A supported version range, and where it was declared
+type VersionRequirement struct {
+	Range  string
+	Source string
+}
+
+// Finds the binary of an agent, without asking anything
+// A path in morio.yaml takes precedence, and must be valid
+func FindBeat(agent string) (string, string, error) {
+	beat := agentBeatName(agent)
+	key := "agents." + agent
+	if path := viper.GetString(key); path != "" {
+		if err := isExecutable(path); err != nil {
+			return "", "", fmt.Errorf("%s in morio.yaml is set to %s: %v", key, path, err)
+		}
+		return path, "morio.yaml", nil
+	}
+	if path, err := exec.LookPath(beat); err == nil {
+		return path, "PATH", nil
+	}
+	for _, location := range beatLocations {
+		path := strings.ReplaceAll(location, "{beat}", beat)
+		if isExecutable(path) == nil {
+			return path, "common location", nil
+		}
+	}
+
+	return "", "", fmt.Errorf("unable to find %s, install it or set %s in %s", beat, key, GetConfigPath("morio.yaml"))
+}
+
+func isExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("is a directory")
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("is not executable")
+	}
+
+	return nil
+}
+
+var beatVersionPattern = regexp.MustCompile(`version (\d+\.\d+\.\d+)`)
+
+// Runs '<beat> version' and returns the version, like 8.12.0
+func BeatVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, path, "version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("'%s version' failed: %v", path, err)
+	}
+	match := beatVersionPattern.FindStringSubmatch(string(output))
+	if match == nil {
+		return "", fmt.Errorf("unable to parse the output of '%s version': %s", path, strings.TrimSpace(string(output)))
+	}
+
+	return match[1], nil
+}
+
+// Returns the version ranges an agent must satisfy
+// These come from versions.<agent> in morio.yaml (or the default),
+// and from 'requires' in the MORIO_DOCS of the enabled templates.
+func AgentVersionRequirements(agent string) []VersionRequirement {
+	global := VersionRequirement{DefaultBeatVersions, "the Morio client"}
+	if value := viper.GetString("versions." + agent); value != "" {
+		global = VersionRequirement{value, "morio.yaml"}
+	}
+	requires := []VersionRequirement{global}
+	for _, target := range TemplateTargets {
+		if target.Agent != agent {
+			continue
+		}
+		for _, from := range target.Sources() {
+			if _, err := os.Stat(GetConfigPath(from)); err != nil {
+				continue
+			}
+			// Lint reports invalid MORIO_DOCS, so we don't
+			docs, _ := ParseTemplateDocs(from)
+			if value, ok := docs["requires"].(string); ok && strings.TrimSpace(value) != "" {
+				requires = append(requires, VersionRequirement{strings.TrimSpace(value), from})
+			}
+		}
+	}
+
+	return requires
+}
+
+// Finds the binary of an agent, and checks its version
+func CheckBeat(agent string) BeatBinary {
+	binary := BeatBinary{Agent: agent, Beat: agentBeatName(agent)}
+	path, source, err := FindBeat(agent)
+	if err != nil {
+		binary.Problems = append(binary.Problems, err.Error())
+		return binary
+	}
+	binary.Path = path
+	binary.Source = source
+	// We run the binary to get its version, so it must be verified first
+	path, err = VerifiedBeatPath(agent, false)
+	if err != nil {
+		binary.Problems = append(binary.Problems, err.Error())
+		return binary
+	}
+	binary.Version, err = BeatVersion(path)
+	if err != nil {
+		binary.Problems = append(binary.Problems, err.Error())
+		return binary
+	}
+	binary.Requires = AgentVersionRequirements(agent)
+	for _, requirement := range binary.Requires {
+		ok, err := VersionInRange(binary.Version, requirement.Range)
+		if err != nil {
+			binary.Problems = append(binary.Problems, fmt.Sprintf("invalid version range in %s: %v", requirement.Source, err))
+		} else if !ok {
+			binary.Problems = append(binary.Problems, fmt.Sprintf("%s %s is not supported, %s requires %s", binary.Beat, binary.Version, requirement.Source, requirement.Range))
+		}
+	}
+
+	return binary
+}
+
+// Returns the beat and its version, like 'filebeat 8.12.0'
+func (binary BeatBinary) Summary() string {
+	switch {
+	case binary.Path == "":
+		return binary.Beat + " not found"
+	case binary.Version == "":
+		return binary.Beat + " (unknown version)"
+	}
+
+	return binary.Beat + " " + binary.Version
+}
+
+// Checks a version against a range like '>=8.0.0, <9' or '8.12.2'
+// Conditions are separated by commas or spaces, and must all match
+func VersionInRange(version string, versionRange string) (bool, error) {
+	fields := strings.FieldsFunc(versionRange, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	if len(fields) == 0 {
+		return false, fmt.Errorf("empty range")
+	}
+	for i := 0; i < len(fields); i++ {
+		condition := fields[i]
+		operator := strings.TrimRight(condition, "0123456789.")
+		// Allow a space between the operator and the version, like '>= 8.0'
+		if operator == condition && i+1 < len(fields) {
+			i++
+			condition += fields[i]
+		}
+		operator = condition[:len(condition)-len(strings.TrimLeft(condition, "<>=!"))]
+		wanted := condition[len(operator):]
+		order, err := compareVersions(version, wanted)
+		if err != nil {
+			return false, err
+		}
+		var ok bool
+		switch operator {
+		case "", "=", "==":
+			ok = order == 0
+		case "!=":
+			ok = order != 0
+		case ">":
+			ok = order > 0
+		case ">=":
+			ok = order >= 0
+		case "<":
+			ok = order < 0
+		case "<=":
+			ok = order <= 0
+		default:
+			return false, fmt.Errorf("unknown operator %s in %s", operator, condition)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Compares versions like 8.12.0 and 8.9, where missing parts are 0
+func compareVersions(a string, b string) (int, error) {
+	x, err := versionParts(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := versionParts(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < 3; i++ {
+		if x[i] != y[i] {
+			if x[i] < y[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func versionParts(version string) ([3]int, error) {
+	var parts [3]int
+	fields := strings.Split(version, ".")
+	if version == "" || len(fields) > 3 {
+		return parts, fmt.Errorf("invalid version %s", version)
+	}
+	for i, field := range fields {
+		number, err := strconv.Atoi(field)
+		if err != nil || number < 0 {
+			return parts, fmt.Errorf("invalid version %s", version)
+		}
+		parts[i] = number
+	}
+
+	return parts, nil
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import "testing"
+
+func TestVersionInRange(t *testing.T) {
+	tests := []struct {
+		version string
+		ranges  string
+		want    bool
+	}{
+		{"8.12.0", ">=8.0.0", true},
+		{"7.17.3", ">=8.0.0", false},
+		{"8.0.0", ">=8.0.0", true},
+		{"8.0.0", ">8.0.0", false},
+		{"8.12.0", ">=8.0.0, <9", true},
+		{"9.0.0", ">=8.0.0, <9", false},
+		{"8.12.0", ">=8.0.0 <9", true},
+		{"8.12.0", ">=8.0.0,<9", true},
+		// A space between the operator and the version
+		{"8.12.0", ">= 8.0, < 9", true},
+		{"7.9.0", ">= 8.0, < 9", false},
+		{"8.12.2", "8.12.2", true},
+		{"8.12.2", "=8.12.2", true},
+		{"8.12.2", "==8.12", false},
+		{"8.12.0", "8.12", true},
+		{"8.12.1", "!=8.12.1", false},
+		{"8.12.1", "!=8.12.0", true},
+		{"8.12.1", "<=8.12.1", true},
+		{"8.12.1", "<8.12.1", false},
+		// Parts are compared as numbers, not as text
+		{"8.9.0", "<8.10", true},
+		{"8.10.0", ">8.9", true},
+	}
+	for _, test := range tests {
+		got, err := VersionInRange(test.version, test.ranges)
+		if err != nil {
+			t.Errorf("VersionInRange(%q, %q) returned an error: %v", test.version, test.ranges, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("VersionInRange(%q, %q) = %v, want %v", test.version, test.ranges, got, test.want)
+		}
+	}
+}
+
+func TestVersionInRangeErrors(t *testing.T) {
+	tests := []struct {
+		version string
+		ranges  string
+	}{
+		{"8.12.0", ""},
+		{"8.12.0", " , "},
+		{"8.12.0", "~>8.0"},
+		{"8.12.0", "=>8.0"},
+		{"8.12.0", ">=eight"},
+		{"8.12.0", ">="},
+		{"8.12.0", ">=8.0.0.1"},
+		{"8.12.0", ">=8.-1"},
+		{"8.12.0-SNAPSHOT", ">=8.0.0"},
+	}
+	for _, test := range tests {
+		if _, err := VersionInRange(test.version, test.ranges); err == nil {
+			t.Errorf("VersionInRange(%q, %q) should return an error", test.version, test.ranges)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"8.12.0", "8.12.0", 0},
+		{"8.12", "8.12.0", 0},
+		{"8", "8.0.0", 0},
+		{"8.12.0", "8.9.0", 1},
+		{"8.9.0", "8.12.0", -1},
+		{"9.0.0", "8.99.99", 1},
+		{"8.12.1", "8.12.0", 1},
+		{"7.17.3", "8.0", -1},
+	}
+	for _, test := range tests {
+		got, err := compareVersions(test.a, test.b)
+		if err != nil {
+			t.Errorf("compareVersions(%q, %q) returned an error: %v", test.a, test.b, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A module in the catalog, merged across all agents it touches
+type CatalogEntry struct {
+	Name      string   `json:"name"`
+	About     string   `json:"about"`
+	Category  string   `json:"category"`
+	Tags      []string `json:"tags"`
+	Platforms []string `json:"platforms"`
+	Agents    []string `json:"agents"`
+	// One of enabled, disabled, or partial (enabled for some agents only)
+	Status string `json:"status"`
+}
+
+// Builds the module catalog from the MORIO_DOCS of all module templates
+func ModuleCatalog() []CatalogEntry {
+	found := make(map[string]*CatalogEntry)
+	enabledCount := make(map[string]int)
+	disabledCount := make(map[string]int)
+
+	for _, folder := range moduleFolders {
+		agent := strings.Split(folder, "/")[0]
+		enabled, disabled := ModuleList(folder)
+		for _, file := range append(enabled, disabled...) {
+			name := ModuleNameFromFile(file)
+			entry, ok := found[name]
+			if !ok {
+				entry = &CatalogEntry{Name: name}
+				found[name] = entry
+			}
+			if filepath.Ext(file) == ".disabled" {
+				disabledCount[name]++
+			} else {
+				enabledCount[name]++
+			}
+			entry.Agents = joinUnique(entry.Agents, []string{agent})
+
+			docs := TemplateDocsAsYaml(folder + "/" + file)
+			if about, ok := docs["about"].(string); ok && entry.About == "" {
+				entry.About = strings.TrimSpace(about)
+			}
+			if category, ok := docs["category"].(string); ok && entry.Category == "" {
+				entry.Category = category
+			}
+			entry.Tags = joinUnique(entry.Tags, docsList(docs["tags"]))
+			entry.Platforms = joinUnique(entry.Platforms, docsList(docs["platforms"]))
+		}
+	}
+
+	catalog := make([]CatalogEntry, 0, len(found))
+	for name, entry := range found {
+		switch {
+		case disabledCount[name] == 0:
+			entry.Status = "enabled"
+		case enabledCount[name] == 0:
+			entry.Status = "disabled"
+		default:
+			entry.Status = "partial"
+		}
+		sort.Strings(entry.Agents)
+		sort.Strings(entry.Tags)
+		sort.Strings(entry.Platforms)
+		catalog = append(catalog, *entry)
+	}
+	sort.Slice(catalog, func(i, j int) bool {
+		return catalog[i].Name < catalog[j].Name
+	})
+
+	return catalog
+}
+
+// Returns true if all words in the search term appear in the entry
+func (entry CatalogEntry) Matches(term string) bool {
+	text := strings.ToLower(strings.Join([]string{
+		entry.Name,
+		entry.About,
+		entry.Category,
+		strings.Join(entry.Tags, " "),
+		strings.Join(entry.Platforms, " "),
+	}, " "))
+	for _, word := range strings.Fields(strings.ToLower(term)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (entry CatalogEntry) HasTag(tag string) bool {
+	for _, t := range entry.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keeps the catalog entries that match all filters
+type CatalogFilter struct {
+	Tags     []string
+	Category string
+	Status   string
+	Term     string
+}
+
+func FilterCatalog(catalog []CatalogEntry, filter CatalogFilter) []CatalogEntry {
+	var result []CatalogEntry
+	for _, entry := range catalog {
+		if filter.Category != "" && !strings.EqualFold(entry.Category, filter.Category) {
+			continue
+		}
+		if filter.Status != "" && entry.Status != filter.Status {
+			continue
+		}
+		if filter.Term != "" && !entry.Matches(filter.Term) {
+			continue
+		}
+		match := true
+		for _, tag := range filter.Tags {
+			if !entry.HasTag(tag) {
+				match = false
+			}
+		}
+		if match {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+func ShowCatalog(catalog []CatalogEntry) {
+	if len(catalog) == 0 {
+		fmt.Println("No modules found")
+		return
+	}
+	for _, entry := range catalog {
+		about := strings.SplitN(entry.About, "\n", 2)[0]
+		fmt.Printf("%-20s %-9s %-20s %s\n", entry.Name, entry.Status, strings.Join(entry.Agents, ","), about)
+		if len(entry.Tags) > 0 || entry.Category != "" {
+			details := []string{}
+			if entry.Category != "" {
+				details = append(details, "category: "+entry.Category)
+			}
+			if len(entry.Tags) > 0 {
+				details = append(details, "tags: "+strings.Join(entry.Tags, ", "))
+			}
+			fmt.Printf("%-20s %s\n", "", strings.Join(details, " | "))
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// morio audit compliance
+var auditComplianceCmd = &cobra.Command{
+	Use:   "compliance",
+	Short: "Manage compliance rule packs",
+	Long: `Manages compliance packs, like CIS or STIG audit rule presets.
+
+A compliance pack is a set of rule templates in audit/rule-templates.d
+that list the pack and the controls they implement in MORIO_DOCS:
+
+  {{#MORIO_DOCS}}
+  about: CIS audit rules for changes to users and groups
+  compliance:
+    packs: [cis-level1, cis-level2]
+    controls:
+      4.1.3.8:
+        about: Ensure events that modify user/group information are collected
+        rules:
+          - -w /etc/group -p wa -k identity
+          - -w /etc/passwd -p wa -k identity
+  {{/MORIO_DOCS}}
+
+The rules of a control are compared to the rendered audit rules, so a
+control is also covered when its rules come from another template.`,
+}
+
+// morio audit compliance list
+var auditComplianceListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List compliance packs",
+	Long:  `Lists the compliance packs, and whether their rule templates are enabled.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		packs := CompliancePacks()
+		if len(packs) == 0 {
+			fmt.Println("No compliance packs found in " + GetConfigPath("audit/rule-templates.d"))
+			return
+		}
+		for _, pack := range packs {
+			fmt.Printf("%-20s %-9s %d templates, %d controls\n", pack.Name, pack.Status(), len(pack.Templates), len(pack.Controls))
+		}
+	},
+}
+
+// morio audit compliance enable
+var auditComplianceEnableCmd = &cobra.Command{
+	Use:     "enable [pack]",
+	Short:   "Enable a compliance pack",
+	Long:    `Enables all rule templates of a compliance pack.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio audit compliance enable cis-level2",
+	Run: func(cmd *cobra.Command, args []string) {
+		pack, err := LoadCompliancePack(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, template := range pack.Templates {
+			enableModuleFile("audit/rule-templates.d", ModuleNameFromFile(template))
+		}
+		fmt.Println("Compliance pack " + pack.Name + " enabled. Run 'morio apply' to update the audit rules.")
+	},
+}
+
+// morio audit compliance disable
+var auditComplianceDisableCmd = &cobra.Command{
+	Use:   "disable [pack]",
+	Short: "Disable a compliance pack",
+	Long: `Disables all rule templates of a compliance pack.
+Templates that are also part of another enabled pack are left enabled.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio audit compliance disable cis-level2",
+	Run: func(cmd *cobra.Command, args []string) {
+		pack, err := LoadCompliancePack(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		// Keep the templates that other enabled packs need
+		needed := make(map[string]bool)
+		for _, other := range CompliancePacks() {
+			if other.Name != pack.Name && other.Status() == "enabled" {
+				for _, template := range other.Templates {
+					needed[ModuleNameFromFile(template)] = true
+				}
+			}
+		}
+		for _, template := range pack.Templates {
+			if !needed[ModuleNameFromFile(template)] {
+				disableModuleFile("audit/rule-templates.d", ModuleNameFromFile(template))
+			}
+		}
+		fmt.Println("Compliance pack " + pack.Name + " disabled. Run 'morio apply' to update the audit rules.")
+	},
+}
+
+// morio audit compliance report
+var auditComplianceReportCmd = &cobra.Command{
+	Use:   "report [pack]",
+	Short: "Report on the controls of a compliance pack",
+	Long: `Maps each control of a compliance pack to the rendered audit rules,
+and shows which controls are covered, partially covered, or missing.
+
+This command exits with status 1 if any control is not fully covered.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio audit compliance report cis-level2",
+	Run: func(cmd *cobra.Command, args []string) {
+		pack, err := LoadCompliancePack(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		rules, _ := LoadAuditRules()
+		if !ShowComplianceReport(pack, ComplianceReport(pack, EffectiveAuditRules(rules))) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	auditCmd.AddCommand(auditComplianceCmd)
+	auditComplianceCmd.AddCommand(auditComplianceListCmd)
+	auditComplianceCmd.AddCommand(auditComplianceEnableCmd)
+	auditComplianceCmd.AddCommand(auditComplianceDisableCmd)
+	auditComplianceCmd.AddCommand(auditComplianceReportCmd)
+}
+
+// A compliance pack, as found in the MORIO_DOCS of rule templates
+type CompliancePack struct {
+	Name string
+	// Rule template files, relative to the config folder
+	Templates []string
+	Enabled   int
+	Controls  map[string]*ComplianceControl
+}
+
+type ComplianceControl struct {
+	ID    string
+	About string
+	Rules []string
+}
+
+// The state of a control on this host
+type ControlStatus struct {
+	Control *ComplianceControl
+	Status  string // covered, partial, or missing
+	Missing []string
+}
+
+// One of enabled, disabled, or partial (some templates are enabled)
+func (pack CompliancePack) Status() string {
+	switch pack.Enabled {
+	case len(pack.Templates):
+		return "enabled"
+	case 0:
+		return "disabled"
+	}
+
+	return "partial"
+}
+
+// Finds all compliance packs in the rule templates
+func CompliancePacks() []CompliancePack {
+	found := make(map[string]*CompliancePack)
+	folder := "audit/rule-templates.d"
+	enabled, disabled := ModuleList(folder)
+	for _, file := range append(enabled, disabled...) {
+		compliance, ok := templateComplianceDocs(folder + "/" + file)
+		if !ok {
+			continue
+		}
+		controls := compliance.ControlEntries()
+		for _, name := range docsList(compliance.Packs) {
+			pack, ok := found[name]
+			if !ok {
+				pack = &CompliancePack{Name: name, Controls: map[string]*ComplianceControl{}}
+				found[name] = pack
+			}
+			pack.Templates = append(pack.Templates, folder+"/"+file)
+			if !strings.HasSuffix(file, ".disabled") {
+				pack.Enabled++
+			}
+			for _, entry := range controls {
+				control, ok := pack.Controls[entry.ID]
+				if !ok {
+					control = &ComplianceControl{ID: entry.ID}
+					pack.Controls[entry.ID] = control
+				}
+				if control.About == "" {
+					control.About = strings.TrimSpace(entry.About)
+				}
+				control.Rules = joinUnique(control.Rules, entry.Rules)
+			}
+		}
+	}
+
+	packs := make([]CompliancePack, 0, len(found))
+	for _, pack := range found {
+		sort.Strings(pack.Templates)
+		packs = append(packs, *pack)
+	}
+	sort.Slice(packs, func(i, j int) bool {
+		return packs[i].Name < packs[j].Name
+	})
+
+	return packs
+}
+
+func LoadCompliancePack(name string) (CompliancePack, error) {
+	for _, pack := range CompliancePacks() {
+		if pack.Name == name {
+			return pack, nil
+		}
+	}
+
+	return CompliancePack{}, fmt.Errorf("compliance pack %s not found, run 'morio audit compliance list' to see the available packs", name)
+}
+
+// Compares the controls of a pack to the rules that will be loaded
+func ComplianceReport(pack CompliancePack, rules []AuditRule) []ControlStatus {
+	loaded := make(map[string]bool)
+	for _, rule := range rules {
+		loaded[auditRuleSignature(rule)] = true
+	}
+
+	var report []ControlStatus
+	for _, id := range sortedControlIDs(pack.Controls) {
+		control := pack.Controls[id]
+		status := ControlStatus{Control: control}
+		for _, text := range control.Rules {
+			rule, err := ParseAuditRule(text)
+			if err != nil || !loaded[auditRuleSignature(rule)] {
+				status.Missing = append(status.Missing, text)
+			}
+		}
+		switch {
+		case len(status.Missing) == 0:
+			status.Status = "covered"
+		case len(status.Missing) < len(control.Rules):
+			status.Status = "partial"
+		default:
+			status.Status = "missing"
+		}
+		report = append(report, status)
+	}
+
+	return report
+}
+
+// Prints the report, and returns true if all controls are covered
+func ShowComplianceReport(pack CompliancePack, report []ControlStatus) bool {
+	fmt.Printf("Compliance pack %s (%s, %d templates)\n\n", pack.Name, pack.Status(), len(pack.Templates))
+	counts := make(map[string]int)
+	for _, status := range report {
+		counts[status.Status]++
+		fmt.Printf("  %-8s %-12s %s\n", strings.ToUpper(status.Status), status.Control.ID, strings.SplitN(status.Control.About, "\n", 2)[0])
+		if status.Status == "partial" {
+			for _, text := range status.Missing {
+				fmt.Printf("  %-8s %-12s missing: %s\n", "", "", text)
+			}
+		}
+	}
+	fmt.Printf("\n%d controls: %d covered, %d partially covered, %d missing\n", len(report), counts["covered"], counts["partial"], counts["missing"])
+	if counts["covered"] < len(report) && pack.Status() != "enabled" {
+		fmt.Println("Run 'morio audit compliance enable " + pack.Name + "' and 'morio apply' to load the missing rules.")
+	}
+
+	return counts["covered"] == len(report)
+}
+
+// Sorts control IDs like 4.1.3.9 before 4.1.3.10
+func sortedControlIDs(controls map[string]*ComplianceControl) []string {
+	ids := sortedKeys(controls)
+	sort.SliceStable(ids, func(i, j int) bool {
+		a := strings.FieldsFunc(ids[i], isControlSeparator)
+		b := strings.FieldsFunc(ids[j], isControlSeparator)
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] == b[k] {
+				continue
+			}
+			x, errX := strconv.Atoi(a[k])
+			y, errY := strconv.Atoi(b[k])
+			if errX == nil && errY == nil {
+				return x < y
+			}
+			return a[k] < b[k]
+		}
+		return len(a) < len(b)
+	})
+
+	return ids
+}
+
+// The compliance section of the MORIO_DOCS of a rule template
+// The controls are kept as a YAML node, because control IDs like 4.10
+// are numbers in YAML, and would come out as 4.1 once decoded.
+type complianceDocs struct {
+	Packs    interface{} `yaml:"packs"`
+	Controls yaml.Node   `yaml:"controls"`
+}
+
+func templateComplianceDocs(path string) (complianceDocs, bool) {
+	var docs struct {
+		Compliance *complianceDocs `yaml:"compliance"`
+	}
+	template, err := RenderTemplateDocs(path)
+	if err == nil {
+		err = yaml.Unmarshal([]byte(template), &docs)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Unable to parse MORIO_DOCS in %s: %v\n", TemplatePath(path), err)
+		return complianceDocs{}, false
+	}
+	if docs.Compliance == nil {
+		return complianceDocs{}, false
+	}
+
+	return *docs.Compliance, true
+}
+
+// Returns the controls, with their IDs as written in the template
+func (docs complianceDocs) ControlEntries() []ComplianceControl {
+	var controls []ComplianceControl
+	if docs.Controls.Kind != yaml.MappingNode {
+		return controls
+	}
+	for i := 0; i+1 < len(docs.Controls.Content); i += 2 {
+		var entry struct {
+			About string      `yaml:"about"`
+			Rules interface{} `yaml:"rules"`
+		}
+		docs.Controls.Content[i+1].Decode(&entry)
+		controls = append(controls, ComplianceControl{
+			ID:    docs.Controls.Content[i].Value,
+			About: entry.About,
+			Rules: docsList(entry.Rules),
+		})
+	}
+
+	return controls
+}
+
+func isControlSeparator(r rune) bool {
+	return r == '.' || r == '-'
+}
@@ -0,0 +1,441 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"morio/version"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// morio daemon
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run the client as a daemon with a local control API",
+	Long: `Runs the client as a long-running daemon, that serves an HTTP/JSON API
+on a unix socket that only root can use. This allows local tools to drive
+the client without parsing the output of the commands.
+
+  GET    /v1/version                     The client version
+  GET    /v1/status[?deep=true]          Agent status, and health with deep
+  POST   /v1/agents/{agent}/{action}     Start, stop or restart an agent
+  GET    /v1/vars                        All vars and their values
+  GET    /v1/vars/{name}                 One var
+  PUT    /v1/vars/{name}                 Set a var, with {"value": "..."}
+  DELETE /v1/vars/{name}                 Remove a custom var
+  GET    /v1/modules                     The module catalog
+  POST   /v1/modules/{name}/{action}     Enable or disable a module
+  POST   /v1/template[?all=true]         Template out the configuration
+  POST   /v1/apply                       Template out, and restart changed agents
+  GET    /v1/drift                       Files that drifted
+
+Errors are returned as {"error": "..."}. Requests are handled one at a time.
+
+Use --reconcile to also re-render the configuration and restart the
+affected agents whenever it is out of date, at the interval you pass.
+Files that were modified by hand, and orphaned files, are logged and left
+alone. Run 'morio drift' to see them.`,
+	Example: `  morio daemon
+  morio daemon --reconcile 5m
+  curl --unix-socket /var/run/morio/morio.sock http://morio/v1/status`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := RunDaemon(daemonSocket, daemonReconcile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var daemonSocket string
+var daemonReconcile time.Duration
+
+func init() {
+	RootCmd.AddCommand(daemonCmd)
+	daemonCmd.Flags().StringVar(&daemonSocket, "socket", AgentSocketFolder+"/morio.sock", "Unix socket to listen on")
+	daemonCmd.Flags().DurationVar(&daemonReconcile, "reconcile", 0, "Re-render drifted configuration at this interval (0 disables this)")
+}
+
+// The daemon handles one request, or reconcile, at a time, as they all
+// read and write the same files
+var daemonLock sync.Mutex
+
+// Serves the API until we get SIGINT or SIGTERM
+func RunDaemon(socket string, reconcile time.Duration) error {
+	listener, err := listenUnixSocket(socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+
+	mux := http.NewServeMux()
+	daemonRoutes(mux)
+	server := &http.Server{Handler: daemonMiddleware(mux), ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if reconcile > 0 {
+		go reconcileLoop(ctx, reconcile)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	fmt.Fprintf(os.Stderr, "Serving the API on %s\n", socket)
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	fmt.Fprintln(os.Stderr, "Shutting down")
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return server.Shutdown(shutdown)
+}
+
+// Listens on a unix socket that only root can use
+// FIXME: Make this platform agnostic
+func listenUnixSocket(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0750); err != nil {
+		return nil, err
+	}
+	// Remove the socket of a daemon that did not shut down cleanly
+	if info, err := os.Lstat(socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socket)
+		}
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another daemon is listening on %s", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// Re-renders the configuration when it drifts, and restarts the affected agents
+func reconcileLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			daemonLock.Lock()
+			reconcile()
+			daemonLock.Unlock()
+		}
+	}
+}
+
+func reconcile() {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Reconcile failed: %v\n", err)
+		}
+	}()
+	drift, err := DetectDrift()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Reconcile failed: %v\n", err)
+		return
+	}
+	// Only out-of-date files are fixed by rendering them again
+	outOfDate := 0
+	for _, report := range drift {
+		switch report.State {
+		case "out-of-date":
+			outOfDate++
+		case "hand-modified":
+			fmt.Fprintf(os.Stderr, "Reconcile: %s was modified by hand, leaving it alone\n", report.File)
+		default:
+			fmt.Fprintf(os.Stderr, "Reconcile: %s is %s (%s), leaving it alone\n", report.File, report.State, report.Reason)
+		}
+	}
+	if outOfDate == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Reconcile: %d files are out of date, re-rendering\n", outOfDate)
+	changed, err := TemplateOutOfDate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Reconcile failed: %v\n", err)
+		return
+	}
+	result := RestartChangedAgents(changed)
+	for _, agent := range result.Restarted {
+		fmt.Fprintf(os.Stderr, "Reconcile: restarted %s agent\n", agent)
+	}
+	for _, message := range result.Errors {
+		fmt.Fprintf(os.Stderr, "Error: Reconcile: %s\n", message)
+	}
+}
+
+func daemonRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /v1/version", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"version": version.Version})
+	})
+
+	mux.HandleFunc("GET /v1/status", func(w http.ResponseWriter, r *http.Request) {
+		var status []AgentStatus
+		for _, agent := range Agents {
+			status = append(status, GetAgentStatus(agent, r.URL.Query().Get("deep") == "true"))
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	mux.HandleFunc("POST /v1/agents/{agent}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		agent := r.PathValue("agent")
+		action := r.PathValue("action")
+		if !contains(Agents, agent) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown agent %s", agent))
+			return
+		}
+		if action != "start" && action != "stop" && action != "restart" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown action %s, use start, stop, or restart", action))
+			return
+		}
+		if err := ChangeAgentState(agent, action); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to %s %s agent: %v", action, agent, err))
+			return
+		}
+		writeJSON(w, http.StatusOK, GetAgentStatus(agent, false))
+	})
+
+	mux.HandleFunc("GET /v1/vars", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, GetVars())
+	})
+
+	mux.HandleFunc("GET /v1/vars/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		value, ok := GetVars()[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("var %s is not set", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, daemonVar(name, value))
+	})
+
+	mux.HandleFunc("PUT /v1/vars/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := checkVarName(name); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		var body struct {
+			Value *string `json:"value"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1024*1024)).Decode(&body); err != nil || body.Value == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("expected a JSON body like {\"value\": \"...\"}"))
+			return
+		}
+		if err := ChangeVar("set", name, *body.Value); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, daemonVar(name, *body.Value))
+	})
+
+	mux.HandleFunc("DELETE /v1/vars/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := checkVarName(name); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if customVarValue(name) == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("var %s is not a custom var", name))
+			return
+		}
+		if err := RemoveVar("rm", name); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /v1/modules", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ModuleCatalog())
+	})
+
+	mux.HandleFunc("POST /v1/modules/{name}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		action := r.PathValue("action")
+		if action != "enable" && action != "disable" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown action %s, use enable or disable", action))
+			return
+		}
+		if _, ok := catalogEntry(name); !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("module %s not found", name))
+			return
+		}
+		if action == "enable" {
+			enableModule(name)
+		} else {
+			disableModule(name)
+		}
+		entry, _ := catalogEntry(name)
+		writeJSON(w, http.StatusOK, entry)
+	})
+
+	mux.HandleFunc("POST /v1/template", func(w http.ResponseWriter, r *http.Request) {
+		changed, err := TemplateAll(r.URL.Query().Get("all") == "true")
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"changed": manifestOutputs(changed)})
+	})
+
+	mux.HandleFunc("POST /v1/apply", func(w http.ResponseWriter, r *http.Request) {
+		result, err := ApplyConfiguration(r.URL.Query().Get("all") == "true")
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	mux.HandleFunc("GET /v1/drift", func(w http.ResponseWriter, r *http.Request) {
+		drift, err := DetectDrift()
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		if drift == nil {
+			drift = []DriftReport{}
+		}
+		writeJSON(w, http.StatusOK, drift)
+	})
+}
+
+// Serializes requests, logs them, and turns panics into errors
+func daemonMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		daemonLock.Lock()
+		defer func() {
+			if err := recover(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s %s panicked: %v\n", r.Method, r.URL.Path, err)
+				if !recorder.written {
+					writeError(recorder, http.StatusInternalServerError, fmt.Errorf("%v", err))
+				}
+			}
+			daemonLock.Unlock()
+			fmt.Fprintf(os.Stderr, "%s %s %d %s\n", r.Method, r.URL.RequestURI(), recorder.status, time.Since(start).Round(time.Millisecond))
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.written = true
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	recorder.written = true
+	return recorder.ResponseWriter.Write(data)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// The state of an agent, as the API returns it
+type AgentStatus struct {
+	Agent    string       `json:"agent"`
+	Running  bool         `json:"running"`
+	Beat     string       `json:"beat"`
+	Path     string       `json:"path"`
+	Source   string       `json:"source"`
+	Version  string       `json:"version"`
+	Problems []string     `json:"problems"`
+	Uptime   float64      `json:"uptime_seconds,omitempty"`
+	Health   *AgentHealth `json:"health,omitempty"`
+	// Why the health could not be read, when asked for
+	HealthError string `json:"health_error,omitempty"`
+}
+
+// Gathers the same information as 'morio status', and more with deep
+func GetAgentStatus(agent string, deep bool) AgentStatus {
+	running, _ := IsAgentRunning(agent)
+	binary := CheckBeat(agent)
+	status := AgentStatus{
+		Agent:    agent,
+		Running:  running,
+		Beat:     binary.Beat,
+		Path:     binary.Path,
+		Source:   binary.Source,
+		Version:  binary.Version,
+		Problems: binary.Problems,
+	}
+	if status.Problems == nil {
+		status.Problems = []string{}
+	}
+	if deep {
+		health, err := GetAgentHealth(agent)
+		if err != nil {
+			status.HealthError = err.Error()
+		} else {
+			status.Health = &health
+			status.Uptime = health.Uptime.Seconds()
+		}
+	}
+
+	return status
+}
+
+func catalogEntry(name string) (CatalogEntry, bool) {
+	for _, entry := range ModuleCatalog() {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+
+	return CatalogEntry{}, false
+}
+
+func daemonVar(name string, value string) map[string]string {
+	source := "default"
+	if customVarValue(name) != nil {
+		source = "custom"
+	}
+
+	return map[string]string{"name": name, "value": value, "source": source}
+}
@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// What we know about the host when looking for modules to suggest
+type HostInventory struct {
+	Processes map[string]bool
+	Ports     map[int]bool
+	Packages  map[string]bool
+}
+
+// Inspects the host for running processes, listening ports and installed packages
+func InspectHost() HostInventory {
+	return HostInventory{
+		Processes: runningProcesses(),
+		Ports:     listeningPorts(),
+		Packages:  installedPackages(),
+	}
+}
+
+// Returns the reasons why a module's detect rules match the host
+// An empty list means the module was not detected
+func DetectModule(docs map[string]interface{}, host HostInventory) []string {
+	var reasons []string
+	rules, ok := docs["detect"].(map[string]interface{})
+	if !ok {
+		return reasons
+	}
+
+	for _, name := range docsList(rules["processes"]) {
+		if host.Processes[name] {
+			reasons = append(reasons, "process "+name)
+		}
+	}
+	for _, port := range docsList(rules["ports"]) {
+		number, err := strconv.Atoi(port)
+		if err == nil && host.Ports[number] {
+			reasons = append(reasons, "port "+port)
+		}
+	}
+	for _, name := range docsList(rules["packages"]) {
+		if host.Packages[name] {
+			reasons = append(reasons, "package "+name)
+		}
+	}
+	for _, path := range docsList(rules["paths"]) {
+		if _, err := os.Stat(path); err == nil {
+			reasons = append(reasons, "path "+path)
+		}
+	}
+
+	return reasons
+}
+
+// MORIO_DOCS entries can hold a single value or a list of values
+func docsList(value interface{}) []string {
+	var values []string
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			values = append(values, fmt.Sprintf("%v", item))
+		}
+	case nil:
+	default:
+		values = append(values, fmt.Sprintf("%v", v))
+	}
+
+	return values
+}
+
+// FIXME: Make this platform agnostic
+func runningProcesses() map[string]bool {
+	found := make(map[string]bool)
+	pids, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return found
+	}
+
+	for _, pid := range pids {
+		// comm is truncated to 15 characters, so also look at argv[0]
+		if comm, err := os.ReadFile(pid + "/comm"); err == nil {
+			found[strings.TrimSpace(string(comm))] = true
+		}
+		if cmdline, err := os.ReadFile(pid + "/cmdline"); err == nil && len(cmdline) > 0 {
+			argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+			found[filepath.Base(argv0)] = true
+		}
+	}
+
+	return found
+}
+
+// FIXME: Make this platform agnostic
+func listeningPorts() map[int]bool {
+	found := make(map[int]bool)
+	// TCP sockets in LISTEN state (0A) and bound UDP sockets (07)
+	sources := map[string]string{
+		"/proc/net/tcp":  "0A",
+		"/proc/net/tcp6": "0A",
+		"/proc/net/udp":  "07",
+		"/proc/net/udp6": "07",
+	}
+	for path, state := range sources {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		// Skip the header line
+		scanner.Scan()
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != state {
+				continue
+			}
+			local := fields[1]
+			port, err := strconv.ParseInt(local[strings.LastIndex(local, ":")+1:], 16, 32)
+			if err == nil {
+				found[int(port)] = true
+			}
+		}
+		file.Close()
+	}
+
+	return found
+}
+
+// Reads installed packages from the dpkg status file and the rpm database
+func installedPackages() map[string]bool {
+	found := make(map[string]bool)
+
+	if file, err := os.Open("/var/lib/dpkg/status"); err == nil {
+		name := ""
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "Package: ") {
+				name = strings.TrimPrefix(line, "Package: ")
+			}
+			if strings.HasPrefix(line, "Status: ") && strings.HasSuffix(line, " installed") {
+				found[name] = true
+			}
+		}
+		file.Close()
+	}
+
+	// The rpm database is not a text file, so we let rpm read it for us
+	if _, err := exec.LookPath("rpm"); err == nil {
+		output, err := exec.Command("rpm", "-qa", "--queryformat", "%{NAME}\n").Output()
+		if err == nil {
+			for _, name := range strings.Split(string(output), "\n") {
+				if name != "" {
+					found[name] = true
+				}
+			}
+		}
+	}
+
+	return found
+}
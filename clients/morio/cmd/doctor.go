@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// morio doctor
+var doctorCmd = &cobra.Command{
+	Use:       "doctor [audit|logs|metrics]",
+	Short:     "Check that the agents can run",
+	ValidArgs: Agents,
+	Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Long: `Checks all agents, or the one you pass it, for problems that would keep
+them from running:
+
+  - The binary of the agent can be found, in agents.<agent> in morio.yaml,
+    in the PATH, or in a common install location
+  - The binary of the agent matches its integrity record, see 'morio
+    integrity'. Binaries that do not are not run to check their version.
+  - The version of the agent is supported. The supported range is set in
+    versions.<agent> in morio.yaml (default ` + DefaultBeatVersions + `), and templates
+    can require more with 'requires' in their MORIO_DOCS, like:
+
+      {{#MORIO_DOCS}}
+      requires: ">=8.12.0, <9"
+      {{/MORIO_DOCS}}
+
+  - The configuration of the agent has been rendered
+
+This command exits with status 1 if any problem is found.`,
+	Example: `  morio doctor
+  morio doctor logs`,
+	Run: func(cmd *cobra.Command, args []string) {
+		agents := Agents
+		if len(args) == 1 {
+			agents = args
+		}
+		problems := 0
+		for _, agent := range agents {
+			problems += DoctorAgent(agent)
+		}
+		if problems == 0 {
+			fmt.Println("\nNo problems found")
+			return
+		}
+		fmt.Printf("\n%d problems found\n", problems)
+		os.Exit(1)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+}
+
+// The checks that doctor runs for each agent, they return the problems found
+var doctorChecks = []func(binary BeatBinary) []string{
+	doctorCheckBinary,
+	doctorCheckConfig,
+}
+
+// Runs all checks for an agent, prints the result, and returns the number of problems
+func DoctorAgent(agent string) int {
+	binary := CheckBeat(agent)
+	var problems []string
+	for _, check := range doctorChecks {
+		problems = append(problems, check(binary)...)
+	}
+	emoji := " "
+	if len(problems) > 0 {
+		emoji = "!"
+	}
+	location := ""
+	if binary.Path != "" {
+		location = binary.Path + " (" + binary.Source + ")"
+	}
+	fmt.Printf("%s %-8s %-20s %s\n", emoji, agent, binary.Summary(), location)
+	for _, problem := range problems {
+		fmt.Printf("  %-8s %s\n", "", problem)
+	}
+
+	return len(problems)
+}
+
+func doctorCheckBinary(binary BeatBinary) []string {
+	return binary.Problems
+}
+
+func doctorCheckConfig(binary BeatBinary) []string {
+	if _, err := os.Stat(GetConfigPath(binary.Agent, "config.yaml")); err != nil {
+		return []string{"no rendered configuration, run 'morio template': " + err.Error()}
+	}
+
+	return nil
+}
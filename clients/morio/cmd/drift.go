@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// morio drift
+var driftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Detect configuration drift",
+	Long: `Detects drift between the templates, vars and rendered configuration.
+
+Every time 'morio template' runs, it writes a manifest that holds a hash of
+the source template, the var values, the monitoring endpoint of the agent,
+and the output of each rendered file.
+This command compares that manifest to the current state, and reports:
+
+  - out-of-date files: The template or vars changed since the last render
+  - hand-modified files: The rendered file was edited by hand
+  - orphaned files: The rendered file has no (more) source template
+
+It exits with status 1 when drift is found.
+Use --fix to re-render the configuration.`,
+	Example: `  morio drift
+  morio drift --fix`,
+	Run: func(cmd *cobra.Command, args []string) {
+		drift, err := DetectDrift()
+		if err == nil && len(drift) > 0 && driftFix {
+			ShowDrift(drift)
+			fmt.Println("\nRe-rendering configuration:")
+			if _, err = TemplateAll(false); err == nil {
+				fmt.Println()
+				drift, err = DetectDrift()
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		ShowDrift(drift)
+		if len(drift) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var driftFix bool
+
+func init() {
+	RootCmd.AddCommand(driftCmd)
+	driftCmd.Flags().BoolVar(&driftFix, "fix", false, "Re-render the configuration to fix any drift")
+}
+
+// Location of the template manifest
+// FIXME: Make this platform agnostic
+const ManifestFile string = "/etc/morio/template-manifest.json"
+
+// What 'morio template' rendered, keyed by output file
+// LastRun is when all templates were last rendered without errors.
+type TemplateManifest struct {
+	LastRun time.Time                `json:"last_run"`
+	Files   map[string]ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Output     string    `json:"output"`
+	Source     string    `json:"source"`
+	Agent      string    `json:"agent"`
+	Vars       []string  `json:"vars"`
+	SourceHash string    `json:"source_hash"`
+	LayoutHash string    `json:"layout_hash"`
+	VarsHash   string    `json:"vars_hash"`
+	HostHash   string    `json:"host_hash"`
+	OutputHash string    `json:"output_hash"`
+	Rendered   time.Time `json:"rendered"`
+}
+
+// A file that drifted from what the templates and vars say it should be
+type DriftReport struct {
+	File   string `json:"file"`
+	State  string `json:"state"` // out-of-date, hand-modified, or orphaned
+	Reason string `json:"reason"`
+}
+
+func LoadManifest() TemplateManifest {
+	manifest := TemplateManifest{Files: map[string]ManifestEntry{}}
+	data, err := os.ReadFile(ManifestFile)
+	if err != nil {
+		return manifest
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Unable to parse %s: %v\n", ManifestFile, err)
+	}
+	if manifest.Files == nil {
+		manifest.Files = map[string]ManifestEntry{}
+	}
+
+	return manifest
+}
+
+func SaveManifest(manifest TemplateManifest) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	check(err)
+	check(os.WriteFile(ManifestFile, data, 0644))
+}
+
+func DetectDrift() ([]DriftReport, error) {
+	var drift []DriftReport
+	manifest := LoadManifest()
+	context, err := GetContext()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check all files that we expect to be rendered
+	expected := make(map[string]bool)
+	for _, target := range TemplateTargets {
+		for _, from := range target.Sources() {
+			to := target.Output(from)
+			expected[to] = true
+			entry, ok := manifest.Files[to]
+			if !ok {
+				drift = append(drift, DriftReport{to, "out-of-date", "never rendered"})
+			} else if state, reason := FileDrift(entry, context); state != "" {
+				drift = append(drift, DriftReport{to, state, reason})
+			}
+		}
+	}
+
+	// Any other file in the output folders is orphaned
+	for _, target := range TemplateTargets {
+		if !target.Folder {
+			continue
+		}
+		files, err := os.ReadDir(GetConfigPath(target.To))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			to := target.To + "/" + file.Name()
+			suffix := filepath.Ext(file.Name())
+			if file.IsDir() || expected[to] || (suffix != ".yaml" && suffix != ".disabled" && suffix != ".rules") {
+				continue
+			}
+			if _, ok := manifest.Files[to]; ok {
+				drift = append(drift, DriftReport{to, "orphaned", "source template was removed or disabled"})
+			} else {
+				drift = append(drift, DriftReport{to, "orphaned", "not rendered by morio"})
+			}
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		return drift[i].File < drift[j].File
+	})
+
+	return drift, nil
+}
+
+// Compares a rendered file to its manifest entry
+// Returns an empty state if the file is up to date
+func FileDrift(entry ManifestEntry, context map[string]string) (string, string) {
+	output, err := os.ReadFile(GetConfigPath(entry.Output))
+	if err != nil {
+		return "out-of-date", "rendered file is missing"
+	}
+	if hashString(string(output)) != entry.OutputHash {
+		return "hand-modified", "content differs from what was rendered"
+	}
+	if hashFile(GetConfigPath(entry.Source)) != entry.SourceHash {
+		return "out-of-date", "template " + entry.Source + " changed"
+	}
+	if hashFile(GetConfigPath("template-layout.mustache")) != entry.LayoutHash {
+		return "out-of-date", "template layout changed"
+	}
+	if hashVars(context, entry.Vars) != entry.VarsHash {
+		return "out-of-date", "vars changed"
+	}
+	if hashAgentHost(entry.Source) != entry.HostHash {
+		return "out-of-date", "monitoring endpoint changed"
+	}
+
+	return "", ""
+}
+
+func ShowDrift(drift []DriftReport) {
+	if len(drift) == 0 {
+		fmt.Println("No drift detected")
+		return
+	}
+	for _, state := range []string{"out-of-date", "hand-modified", "orphaned"} {
+		header := false
+		for _, report := range drift {
+			if report.State != state {
+				continue
+			}
+			if !header {
+				fmt.Println(strings.ToUpper(state[:1]) + state[1:] + " files:")
+				header = true
+			}
+			fmt.Println(" - " + GetConfigPath(report.File) + " (" + report.Reason + ")")
+		}
+	}
+}
+
+func hashString(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func hashFile(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	return hashString(string(data))
+}
+
+// Hashes the values of the vars with the given names, as they resolve
+func hashVars(context map[string]string, names []string) string {
+	// Vars that do not resolve are hashed as they are, they fail to render
+	if resolved, _, err := ResolveVars(context, names); err == nil {
+		context = resolved
+	}
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s=%q\n", name, context[name])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Hashes the monitoring endpoint of the agent a template belongs to, if
+// the output holds it: agent configurations, and templates that use the
+// MORIO_AGENT_HTTP_HOST var. It is a run-time var, so not in the vars hash.
+func hashAgentHost(source string) string {
+	agent := agentFromTemplate(source, GetConfigPath())
+	if agent == "" {
+		return ""
+	}
+	if !strings.HasSuffix(source, ".mustache") {
+		data, err := os.ReadFile(TemplatePath(source))
+		if err != nil || !strings.Contains(string(data), "MORIO_AGENT_HTTP_HOST") {
+			return ""
+		}
+	}
+
+	return hashString(AgentHTTPHost(agent))
+}
+
+func isRuntimeVar(key string) bool {
+	for _, name := range runtimeVars {
+		if key == name {
+			return true
+		}
+	}
+
+	return false
+}
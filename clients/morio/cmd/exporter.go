@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"io"
+	"morio/version"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// morio exporter
+var exporterCmd = &cobra.Command{
+	Use:   "exporter",
+	Short: "Expose client and agent metrics to Prometheus",
+	Long: `Runs an HTTP server that exposes metrics about the client and the agents
+in the Prometheus text format on /metrics:
+
+  - Whether the agents run, and how often they were restarted
+  - Whether the agent binaries are found, supported, and match their record
+  - The time since all templates were last rendered without errors
+  - The number of files that drifted from the templates and vars
+  - The expiry of the certificates in the agent configuration
+  - The number of enabled modules
+  - The pipeline counters of the agents, from their monitoring endpoint
+
+The binary checks and the drift are slow to work out, so they are
+refreshed every --refresh in the background. Everything else is gathered
+on every scrape. The exporter needs to run as root to read all of this.`,
+	Example: `  morio exporter
+  morio exporter --listen 0.0.0.0:9780`,
+	Run: func(cmd *cobra.Command, args []string) {
+		RefreshSlowMetrics()
+		go func() {
+			for range time.Tick(exporterRefresh) {
+				RefreshSlowMetrics()
+			}
+		}()
+		http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			WriteMetrics(w)
+		})
+		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintln(w, "Morio client exporter, metrics are on /metrics")
+		})
+		fmt.Fprintf(os.Stderr, "Serving metrics on http://%s/metrics\n", exporterListen)
+		if err := http.ListenAndServe(exporterListen, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var exporterListen string
+var exporterRefresh time.Duration
+
+func init() {
+	RootCmd.AddCommand(exporterCmd)
+	exporterCmd.Flags().StringVar(&exporterListen, "listen", "127.0.0.1:9780", "Address to serve the metrics on")
+	exporterCmd.Flags().DurationVar(&exporterRefresh, "refresh", time.Minute, "Refresh the binary checks and the drift at this interval")
+}
+
+// A metric in the Prometheus text format
+type Metric struct {
+	Name    string
+	Type    string // gauge or counter
+	Help    string
+	Samples []MetricSample
+}
+
+type MetricSample struct {
+	// Label pairs, like agent, logs
+	Labels []string
+	Value  float64
+}
+
+func (metric *Metric) Add(value float64, labels ...string) {
+	metric.Samples = append(metric.Samples, MetricSample{labels, value})
+}
+
+// Writes the metric, unless it has no samples
+func (metric *Metric) Write(w io.Writer) {
+	if len(metric.Samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", metric.Name, metric.Help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", metric.Name, metric.Type)
+	for _, sample := range metric.Samples {
+		var labels []string
+		for i := 0; i+1 < len(sample.Labels); i += 2 {
+			labels = append(labels, sample.Labels[i]+`="`+metricLabelEscaper.Replace(sample.Labels[i+1])+`"`)
+		}
+		name := metric.Name
+		if len(labels) > 0 {
+			name += "{" + strings.Join(labels, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(sample.Value, 'f', -1, 64))
+	}
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Gathers all metrics and writes them
+func WriteMetrics(w io.Writer) {
+	start := time.Now()
+	var buffer bytes.Buffer
+	for _, metric := range GatherMetrics() {
+		metric.Write(&buffer)
+	}
+	scrape := Metric{Name: "morio_exporter_scrape_duration_seconds", Type: "gauge", Help: "Time it took to gather the metrics"}
+	scrape.Add(time.Since(start).Seconds())
+	scrape.Write(&buffer)
+	w.Write(buffer.Bytes())
+}
+
+// The results of the checks that are too slow to run on every scrape
+type slowMetrics struct {
+	sync.Mutex
+	updated time.Time
+	// By agent
+	binaryOK map[string]bool
+	// By state, nil when the drift could not be detected
+	drift map[string]int
+}
+
+var exporterCache slowMetrics
+
+// Runs the slow checks, and caches their results for the scrapes
+func RefreshSlowMetrics() {
+	binaryOK := make(map[string]bool)
+	for _, agent := range Agents {
+		binaryOK[agent] = len(CheckBeat(agent).Problems) == 0
+	}
+	drift := slowDriftCounts()
+
+	exporterCache.Lock()
+	defer exporterCache.Unlock()
+	exporterCache.updated = time.Now()
+	exporterCache.binaryOK = binaryOK
+	exporterCache.drift = drift
+}
+
+func slowDriftCounts() (counts map[string]int) {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Unable to detect drift: %v\n", err)
+			counts = nil
+		}
+	}()
+	reports, err := DetectDrift()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Unable to detect drift: %v\n", err)
+		return nil
+	}
+	counts = make(map[string]int)
+	for _, report := range reports {
+		counts[report.State]++
+	}
+
+	return counts
+}
+
+// Returns the cached results, running the checks if they never ran
+func cachedSlowMetrics() (map[string]bool, map[string]int) {
+	exporterCache.Lock()
+	updated := exporterCache.updated
+	exporterCache.Unlock()
+	if updated.IsZero() {
+		RefreshSlowMetrics()
+	}
+	exporterCache.Lock()
+	defer exporterCache.Unlock()
+
+	return exporterCache.binaryOK, exporterCache.drift
+}
+
+func GatherMetrics() []*Metric {
+	info := &Metric{Name: "morio_client_info", Type: "gauge", Help: "Version of the Morio client"}
+	info.Add(1, "version", version.Version)
+	metrics := []*Metric{info}
+	metrics = append(metrics, agentMetrics()...)
+	metrics = append(metrics, renderMetrics()...)
+	metrics = append(metrics, certificateMetrics())
+	metrics = append(metrics, moduleMetrics())
+
+	return metrics
+}
+
+func agentMetrics() []*Metric {
+	up := &Metric{Name: "morio_agent_up", Type: "gauge", Help: "Whether the agent service is running"}
+	restarts := &Metric{Name: "morio_agent_restarts_total", Type: "counter", Help: "Number of times the service manager restarted the agent"}
+	binary := &Metric{Name: "morio_agent_binary_ok", Type: "gauge", Help: "Whether the agent binary is found, supported, and matches its integrity record"}
+	monitoring := &Metric{Name: "morio_agent_monitoring_up", Type: "gauge", Help: "Whether the monitoring endpoint of the agent answered"}
+	published := &Metric{Name: "morio_agent_events_published_total", Type: "counter", Help: "Events published to the pipeline of the agent"}
+	acked := &Metric{Name: "morio_agent_events_acked_total", Type: "counter", Help: "Events acknowledged by the output"}
+	failed := &Metric{Name: "morio_agent_events_failed_total", Type: "counter", Help: "Events that failed in the pipeline or the output"}
+	dropped := &Metric{Name: "morio_agent_events_dropped_total", Type: "counter", Help: "Events dropped by the pipeline or the output"}
+	active := &Metric{Name: "morio_agent_events_active", Type: "gauge", Help: "Events in the pipeline that were not acknowledged yet"}
+	writeErrors := &Metric{Name: "morio_agent_output_write_errors_total", Type: "counter", Help: "Errors writing to the output"}
+	readErrors := &Metric{Name: "morio_agent_output_read_errors_total", Type: "counter", Help: "Errors reading from the output"}
+	queueEvents := &Metric{Name: "morio_agent_queue_events", Type: "gauge", Help: "Events in the queue of the agent"}
+	queueMax := &Metric{Name: "morio_agent_queue_max_events", Type: "gauge", Help: "Maximum number of events in the queue of the agent"}
+	queueFilled := &Metric{Name: "morio_agent_queue_filled_ratio", Type: "gauge", Help: "How full the queue of the agent is, from 0 to 1"}
+	harvesters := &Metric{Name: "morio_agent_harvesters_running", Type: "gauge", Help: "Harvesters running in the logs agent"}
+	openFiles := &Metric{Name: "morio_agent_open_files", Type: "gauge", Help: "Files held open by the harvesters of the logs agent"}
+
+	binaryOK, _ := cachedSlowMetrics()
+	for _, agent := range Agents {
+		running, _ := IsAgentRunning(agent)
+		up.Add(boolMetric(running), "agent", agent)
+		if count, err := agentRestarts(agent); err == nil {
+			restarts.Add(float64(count), "agent", agent)
+		}
+		binary.Add(boolMetric(binaryOK[agent]), "agent", agent)
+
+		health, err := GetAgentHealth(agent)
+		monitoring.Add(boolMetric(err == nil), "agent", agent)
+		if err != nil {
+			continue
+		}
+		published.Add(float64(health.Published), "agent", agent)
+		acked.Add(float64(health.Acked), "agent", agent)
+		failed.Add(float64(health.Failed), "agent", agent)
+		dropped.Add(float64(health.Dropped), "agent", agent)
+		active.Add(float64(health.Active), "agent", agent)
+		writeErrors.Add(float64(health.WriteErrors), "agent", agent)
+		readErrors.Add(float64(health.ReadErrors), "agent", agent)
+		queueEvents.Add(float64(health.QueueEvents), "agent", agent)
+		queueMax.Add(float64(health.QueueMax), "agent", agent)
+		queueFilled.Add(health.QueueFilled, "agent", agent)
+		if health.HasHarvester {
+			harvesters.Add(float64(health.Harvesters), "agent", agent)
+			openFiles.Add(float64(health.OpenFiles), "agent", agent)
+		}
+	}
+
+	return []*Metric{up, restarts, binary, monitoring, published, acked, failed, dropped, active, writeErrors, readErrors, queueEvents, queueMax, queueFilled, harvesters, openFiles}
+}
+
+// Returns how often the service manager restarted an agent
+func agentRestarts(agent string) (int, error) {
+	if runtime.GOOS != "linux" {
+		return 0, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+	output, err := exec.Command("systemctl", "show", "--property=NRestarts", "--value", agentServiceName(agent)).Output()
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(output)))
+}
+
+func renderMetrics() []*Metric {
+	age := &Metric{Name: "morio_template_last_render_age_seconds", Type: "gauge", Help: "Time since all templates were last rendered without errors"}
+	if last := LoadManifest().LastRun; !last.IsZero() {
+		age.Add(time.Since(last).Seconds())
+	}
+
+	drift := &Metric{Name: "morio_config_drift_files", Type: "gauge", Help: "Configuration files that drifted from the templates and vars, by state"}
+	if _, counts := cachedSlowMetrics(); counts != nil {
+		for _, state := range []string{"out-of-date", "hand-modified", "orphaned"} {
+			drift.Add(float64(counts[state]), "state", state)
+		}
+	}
+
+	return []*Metric{age, drift}
+}
+
+func certificateMetrics() *Metric {
+	expiry := &Metric{Name: "morio_certificate_expiry_timestamp_seconds", Type: "gauge", Help: "Earliest expiry of the certificates in a file used by an agent"}
+	for _, agent := range Agents {
+		for _, file := range AgentCertificateFiles(agent) {
+			if notAfter, err := certificateExpiry(file); err == nil {
+				expiry.Add(float64(notAfter.Unix()), "agent", agent, "file", file)
+			}
+		}
+	}
+
+	return expiry
+}
+
+// Returns the certificate files in the rendered configuration of an agent,
+// from the ssl.certificate and ssl.certificate_authorities settings
+func AgentCertificateFiles(agent string) []string {
+	data, err := os.ReadFile(GetConfigPath(agent, "config.yaml"))
+	if err != nil {
+		return nil
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil
+	}
+	var files []string
+	var walk func(prefix string, value interface{})
+	walk = func(prefix string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, item := range v {
+				walk(prefix+"."+key, item)
+			}
+		case []interface{}:
+			if strings.HasSuffix(prefix, "ssl.certificate_authorities") {
+				for _, item := range v {
+					if file, ok := item.(string); ok {
+						files = joinUnique(files, []string{file})
+					}
+				}
+			}
+		case string:
+			if strings.HasSuffix(prefix, "ssl.certificate") || strings.HasSuffix(prefix, "ssl.certificate_authorities") {
+				files = joinUnique(files, []string{v})
+			}
+		}
+	}
+	walk("", config)
+	sort.Strings(files)
+
+	return files
+}
+
+// Returns when the first of the certificates in a PEM file expires
+// Inline certificates are skipped, as they are not files.
+func certificateExpiry(file string) (time.Time, error) {
+	if strings.HasPrefix(strings.TrimSpace(file), "-----BEGIN") {
+		return time.Time{}, fmt.Errorf("inline certificate")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var first time.Time
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if first.IsZero() || certificate.NotAfter.Before(first) {
+			first = certificate.NotAfter
+		}
+	}
+	if first.IsZero() {
+		return first, fmt.Errorf("no certificates in %s", file)
+	}
+
+	return first, nil
+}
+
+func moduleMetrics() *Metric {
+	enabled := &Metric{Name: "morio_modules_enabled", Type: "gauge", Help: "Enabled module templates, by folder"}
+	for _, folder := range moduleFolders {
+		if _, err := os.Stat(GetConfigPath(folder)); err != nil {
+			continue
+		}
+		modules, _ := ModuleList(folder)
+		enabled.Add(float64(len(modules)), "folder", folder)
+	}
+
+	return enabled
+}
+
+func boolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
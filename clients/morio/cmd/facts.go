@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"morio/version"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// morio facts
+var factsCmd = &cobra.Command{
+	Use:   "facts",
+	Short: "Show the facts about this host",
+	Long: `Shows the facts that the Morio client collects about this host.
+
+Facts are read-only vars, prefixed with MORIO_FACT_, that are available
+in all templates. They allow templates to adapt to the host they run on.
+Vars can also reference them, like ${MORIO_FACT_HOSTNAME}.`,
+	Example: `  morio facts
+  morio facts --format json`,
+	Run: func(cmd *cobra.Command, args []string) {
+		facts := HostFacts()
+		if factsFormat != "text" {
+			output, err := EncodeVars(facts, factsFormat)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Print(output)
+			return
+		}
+		for _, name := range sortedKeys(facts) {
+			fmt.Printf("%-28s %s\n", name, facts[name])
+		}
+	},
+}
+
+var factsFormat string
+
+func init() {
+	RootCmd.AddCommand(factsCmd)
+	factsCmd.Flags().StringVar(&factsFormat, "format", "text", "The format to use: text, json, yaml, or env")
+}
+
+// All facts are prefixed with this
+const FactPrefix string = "MORIO_FACT_"
+
+func isFact(key string) bool {
+	return strings.HasPrefix(key, FactPrefix)
+}
+
+// Collects the facts about this host
+func HostFacts() map[string]string {
+	hostname, _ := os.Hostname()
+	ip, iface := primaryIP()
+	names, ips := hostInterfaces()
+	distro := osRelease()
+
+	return map[string]string{
+		"MORIO_FACT_HOSTNAME":       hostname,
+		"MORIO_FACT_FQDN":           hostFQDN(hostname),
+		"MORIO_FACT_OS":             runtime.GOOS,
+		"MORIO_FACT_DISTRO":         distro["ID"],
+		"MORIO_FACT_DISTRO_NAME":    distro["NAME"],
+		"MORIO_FACT_DISTRO_VERSION": distro["VERSION_ID"],
+		"MORIO_FACT_KERNEL":         kernelRelease(),
+		"MORIO_FACT_ARCH":           runtime.GOARCH,
+		"MORIO_FACT_CPU_COUNT":      strconv.Itoa(runtime.NumCPU()),
+		"MORIO_FACT_MEMORY":         memoryTotal(),
+		"MORIO_FACT_IP":             ip,
+		"MORIO_FACT_INTERFACE":      iface,
+		"MORIO_FACT_INTERFACES":     strings.Join(joinUnique(nil, names), ","),
+		"MORIO_FACT_IPS":            strings.Join(ips, ","),
+		"MORIO_FACT_CLIENT_UUID":    GetVar("MORIO_CLIENT_UUID"),
+		"MORIO_FACT_CLIENT_VERSION": version.Version,
+	}
+}
+
+// The facts that template tests render with, unless their fixture sets them
+// These are made up, so that tests render the same on all hosts.
+var testFacts = map[string]string{
+	"MORIO_FACT_HOSTNAME":       "morio-test",
+	"MORIO_FACT_FQDN":           "morio-test.example.com",
+	"MORIO_FACT_OS":             "linux",
+	"MORIO_FACT_DISTRO":         "debian",
+	"MORIO_FACT_DISTRO_NAME":    "Debian GNU/Linux",
+	"MORIO_FACT_DISTRO_VERSION": "12",
+	"MORIO_FACT_KERNEL":         "6.1.0-test",
+	"MORIO_FACT_ARCH":           "amd64",
+	"MORIO_FACT_CPU_COUNT":      "4",
+	"MORIO_FACT_MEMORY":         "8589934592",
+	"MORIO_FACT_IP":             "192.0.2.10",
+	"MORIO_FACT_INTERFACE":      "eth0",
+	"MORIO_FACT_INTERFACES":     "eth0,lo",
+	"MORIO_FACT_IPS":            "192.0.2.10,127.0.0.1",
+	"MORIO_FACT_CLIENT_UUID":    "00000000-0000-0000-0000-000000000000",
+	"MORIO_FACT_CLIENT_VERSION": "0.0.0-test",
+}
+
+// Adds the facts to the vars
+// Facts are read-only, so they take precedence over vars with the same name.
+func ContextWithFacts(vars map[string]string, facts map[string]string) map[string]string {
+	context := make(map[string]string, len(vars)+len(facts))
+	for key, value := range vars {
+		context[key] = value
+	}
+	for key, value := range facts {
+		context[key] = value
+	}
+
+	return context
+}
+
+// Resolves the fully qualified domain name of the host
+// Falls back to the hostname if it cannot be resolved.
+// The lookup is done once per process, as the daemon and the exporter
+// build the context over and over.
+func hostFQDN(hostname string) string {
+	if strings.Contains(hostname, ".") {
+		return hostname
+	}
+	if fqdn, ok := fqdnCache.Load(hostname); ok {
+		return fqdn.(string)
+	}
+	fqdn := lookupFQDN(hostname)
+	fqdnCache.Store(hostname, fqdn)
+
+	return fqdn
+}
+
+// Resolved names, by hostname
+var fqdnCache sync.Map
+
+func lookupFQDN(hostname string) string {
+	addresses, err := net.LookupHost(hostname)
+	if err != nil {
+		return hostname
+	}
+	for _, address := range addresses {
+		names, err := net.LookupAddr(address)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if strings.HasPrefix(name, hostname+".") {
+				return name
+			}
+		}
+	}
+
+	return hostname
+}
+
+// Returns the IP address and name of the interface that holds the default route
+func primaryIP() (string, string) {
+	// Connecting a UDP socket does not send any packets, but it does
+	// make the kernel pick the outgoing interface for us.
+	ip := ""
+	if conn, err := net.Dial("udp", "192.0.2.1:9"); err == nil {
+		ip = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+	}
+
+	// No default route, so use the first address that is not a loopback
+	names, ips := hostInterfaces()
+	if ip == "" && len(ips) > 0 {
+		ip = ips[0]
+	}
+	for i, address := range ips {
+		if address == ip {
+			return ip, names[i]
+		}
+	}
+
+	return ip, ""
+}
+
+// Returns the interfaces that are up and not a loopback, and their addresses
+// An interface with multiple addresses is listed once for every address.
+func hostInterfaces() ([]string, []string) {
+	var names []string
+	var ips []string
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return names, ips
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addresses, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			if ip, ok := address.(*net.IPNet); ok && !ip.IP.IsLinkLocalUnicast() {
+				names = append(names, iface.Name)
+				ips = append(ips, ip.IP.String())
+			}
+		}
+	}
+
+	return names, ips
+}
+
+// Reads the distribution info from /etc/os-release
+// FIXME: Make this platform agnostic
+func osRelease() map[string]string {
+	found := make(map[string]string)
+	data, err := os.ReadFile("/etc/os-release")
+	if err != nil {
+		return found
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if ok {
+			found[key] = strings.Trim(value, `"'`)
+		}
+	}
+
+	return found
+}
+
+// FIXME: Make this platform agnostic
+func kernelRelease() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// Returns the total memory in bytes
+// FIXME: Make this platform agnostic
+func memoryTotal() string {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err == nil {
+				return strconv.FormatInt(kb*1024, 10)
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// morio template test
+var templateTestCmd = &cobra.Command{
+	Use:   "test [folder]",
+	Short: "Test templates against golden files",
+	Long: `Renders templates with fixture vars, and compares the result
+to the expected output (golden files).
+
+Every folder below [folder] that holds a test.yaml file is a test case.
+The test.yaml file lists the template to render, and the vars to use:
+
+  # tests/nginx/default/test.yaml
+  template: ../../../logs/module-templates.d/nginx.yaml
+  tags:
+    environment: production
+  vars:
+    NGINX_LOG_PATH: /var/log/nginx
+    MORIO_FACT_HOSTNAME: web01
+
+Paths are relative to the test case folder. The template is rendered
+the same way as 'morio template' does, with the template defaults
+underneath the fixture vars.
+
+Nothing comes from this host, so that tests render the same on all hosts:
+  - Templates are rendered in the template-layout.mustache that ships with
+    them, in the closest folder above the template. Use 'layout' to point
+    to another template layout. The global-vars.yaml next to the layout
+    is used, if there is one.
+  - Facts (MORIO_FACT_*) are made up, like MORIO_FACT_HOSTNAME morio-test,
+    unless the fixture vars set them.
+  - The host tags are the ones in 'tags', or none.
+  - Agent configurations use the default monitoring endpoint, unless the
+    fixture vars set MORIO_AGENT_HTTP_HOST.
+
+The output is compared to expected.yaml in the same folder.
+Use --update to write the rendered output to expected.yaml instead.
+
+This command exits with status 1 if any test fails.`,
+	Args: cobra.ExactArgs(1),
+	Example: `  morio template test ./tests
+  morio template test ./tests --update`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cases, err := TemplateTestCases(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(cases) == 0 {
+			fmt.Fprintln(os.Stderr, "Error: No test cases found in "+args[0])
+			os.Exit(1)
+		}
+		failed := 0
+		for _, folder := range cases {
+			if !RunTemplateTest(folder, templateTestUpdate) {
+				failed++
+			}
+		}
+		fmt.Printf("\n%d passed, %d failed\n", len(cases)-failed, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var templateTestUpdate bool
+
+func init() {
+	templateCmd.AddCommand(templateTestCmd)
+	templateTestCmd.Flags().BoolVar(&templateTestUpdate, "update", false, "Write the rendered output to the golden files")
+}
+
+// A template test case, as read from test.yaml
+type TemplateTest struct {
+	Template string                 `yaml:"template"`
+	Layout   string                 `yaml:"layout"`
+	Tags     map[string]string      `yaml:"tags"`
+	Vars     map[string]interface{} `yaml:"vars"`
+}
+
+// Returns all folders below the given folder that hold a test case
+func TemplateTestCases(folder string) ([]string, error) {
+	var cases []string
+	err := filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && entry.Name() == "test.yaml" {
+			cases = append(cases, filepath.Dir(path))
+		}
+		return nil
+	})
+	sort.Strings(cases)
+
+	return cases, err
+}
+
+// Runs a single test case, and returns true if it passed
+func RunTemplateTest(folder string, update bool) bool {
+	output, err := RenderTemplateTest(folder)
+	if err != nil {
+		fmt.Println("ERROR   " + folder)
+		fmt.Println("        " + err.Error())
+		return false
+	}
+
+	golden := filepath.Join(folder, "expected.yaml")
+	if update {
+		if err := os.WriteFile(golden, []byte(output), 0644); err != nil {
+			fmt.Println("ERROR   " + folder)
+			fmt.Println("        " + err.Error())
+			return false
+		}
+		fmt.Println("UPDATED " + folder)
+		return true
+	}
+
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		fmt.Println("ERROR   " + folder)
+		fmt.Println("        Unable to read golden file, run with --update to create it")
+		return false
+	}
+	if string(expected) == output {
+		fmt.Println("PASS    " + folder)
+		return true
+	}
+	fmt.Println("FAIL    " + folder + " (- expected, + rendered)")
+	for _, line := range lineDiff(string(expected), output) {
+		fmt.Println("        " + line)
+	}
+
+	return false
+}
+
+func RenderTemplateTest(folder string) (string, error) {
+	var test TemplateTest
+	data, err := os.ReadFile(filepath.Join(folder, "test.yaml"))
+	if err != nil {
+		return "", err
+	}
+	if err := yaml.Unmarshal(data, &test); err != nil {
+		return "", fmt.Errorf("unable to parse test.yaml: %v", err)
+	}
+	if test.Template == "" {
+		return "", fmt.Errorf("test.yaml does not specify a template")
+	}
+
+	path, err := filepath.Abs(filepath.Join(folder, test.Template))
+	if err != nil {
+		return "", err
+	}
+	layout := ""
+	if test.Layout != "" {
+		layout = filepath.Join(folder, test.Layout)
+	} else if layout, err = findTemplateLayout(path); err != nil {
+		return "", err
+	}
+
+	// Template defaults, global defaults and fixture tags first, fixture
+	// vars on top. Like facts, nothing comes from this host.
+	root := filepath.Dir(layout)
+	context := ExtractTemplateDefaultVars(path)
+	for key, value := range globalVarDefaults(filepath.Join(root, "global-vars.yaml")) {
+		context[key] = value
+	}
+	for key, value := range TagVars(test.Tags) {
+		context[key] = value
+	}
+	// Facts are made up, so that tests render the same on all hosts
+	facts := make(map[string]string, len(testFacts))
+	for key, value := range testFacts {
+		facts[key] = value
+	}
+	for key, value := range test.Vars {
+		if isFact(key) {
+			facts[key] = stringifyVarValue(value)
+		} else {
+			context[key] = stringifyVarValue(value)
+		}
+	}
+	context = ContextWithFacts(context, facts)
+	// Keep the output independent of where the tests are checked out
+	source := test.Template
+	if value, ok := test.Vars["MORIO_TEMPLATE_SOURCE_FILE"]; ok {
+		source = stringifyVarValue(value)
+	}
+	setRuntimeVars(context, path, source, root)
+	// The monitoring endpoint in morio.yaml is a setting of this host
+	if _, ok := test.Vars["MORIO_AGENT_HTTP_HOST"]; !ok {
+		context["MORIO_AGENT_HTTP_HOST"] = ""
+		if context["MORIO_AGENT"] != "" {
+			context["MORIO_AGENT_HTTP_HOST"] = defaultAgentHTTPHost(context["MORIO_AGENT"])
+		}
+	}
+
+	return renderTemplateInLayout(path, layout, context)
+}
+
+// Returns the layout that ships with a template, never the one on this host
+// That is the template-layout.mustache in the closest folder above it.
+func findTemplateLayout(path string) (string, error) {
+	for folder := filepath.Dir(path); ; folder = filepath.Dir(folder) {
+		layout := filepath.Join(folder, "template-layout.mustache")
+		if _, err := os.Stat(layout); err == nil {
+			return layout, nil
+		}
+		if folder == filepath.Dir(folder) {
+			return "", fmt.Errorf("no template-layout.mustache found above %s, set 'layout' in test.yaml", path)
+		}
+	}
+}
+
+// Returns the lines that differ between two texts, with some context
+func lineDiff(expected string, actual string) []string {
+	a := strings.Split(expected, "\n")
+	b := strings.Split(actual, "\n")
+
+	// Longest common subsequence of lines
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, "  "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+
+	// Only keep 2 lines of context around changes
+	var result []string
+	for index, line := range diff {
+		keep := false
+		for k := max(0, index-2); k <= min(len(diff)-1, index+2); k++ {
+			if diff[k][0] != ' ' {
+				keep = true
+			}
+		}
+		if keep {
+			result = append(result, line)
+		} else if len(result) > 0 && result[len(result)-1] != "  ..." {
+			result = append(result, "  ...")
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,306 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// morio integrity
+var integrityCmd = &cobra.Command{
+	Use:   "integrity",
+	Short: "Manage the integrity records of the agent binaries",
+	Long: `Manages the integrity records of the agent binaries.
+
+Morio runs whatever binary agents.<agent> in morio.yaml points to, so it
+records what that binary should be. When the binary is owned by a package,
+we record the package, and verify the binary with the package manager, so
+that package upgrades are not flagged. Otherwise, we record the SHA-256
+checksum of the binary.
+
+Before Morio runs the binary of an agent, it verifies that the binary is
+owned by root, is not writable by other users, and matches the record.
+This includes 'morio audit', 'morio logs' and 'morio metrics', but also
+checking the version of the agent, previewing its events, and managing
+its keystore. Morio refuses to run the binary otherwise. Only 'morio audit',
+'morio logs' and 'morio metrics' let you skip this, with --insecure as the
+first argument.
+
+Records are written when the client is installed. Run 'morio integrity
+record' after you install or move an agent that is not packaged.`,
+}
+
+// morio integrity record
+var integrityRecordCmd = &cobra.Command{
+	Use:       "record [audit|logs|metrics]",
+	Short:     "Record the agent binaries",
+	Long:      `Records the binaries of all agents, or the one you pass it, as they are now.`,
+	ValidArgs: Agents,
+	Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Example: `  morio integrity record
+  morio integrity record logs`,
+	Run: func(cmd *cobra.Command, args []string) {
+		agents := Agents
+		if len(args) == 1 {
+			agents = args
+		}
+		records := LoadIntegrityRecords()
+		for _, agent := range agents {
+			path, _, err := FindBeat(agent)
+			if err != nil {
+				// Not all hosts run all agents
+				fmt.Fprintf(os.Stderr, "Warning: Not recording %s: %v\n", agent, err)
+				continue
+			}
+			record, err := RecordBeat(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Unable to record %s: %v\n", agent, err)
+				os.Exit(1)
+			}
+			records[agent] = record
+			fmt.Println("Recorded " + agent + ": " + record.Summary())
+		}
+		if err := SaveIntegrityRecords(records); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// morio integrity verify
+var integrityVerifyCmd = &cobra.Command{
+	Use:       "verify [audit|logs|metrics]",
+	Short:     "Verify the agent binaries",
+	Long:      `Verifies the binaries of all agents, or the one you pass it, against their records.`,
+	ValidArgs: Agents,
+	Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	Example: `  morio integrity verify
+  morio integrity verify audit`,
+	Run: func(cmd *cobra.Command, args []string) {
+		agents := Agents
+		if len(args) == 1 {
+			agents = args
+		}
+		failed := false
+		for _, agent := range agents {
+			path, _, err := FindBeat(agent)
+			if err == nil {
+				err = VerifyBeat(agent, path)
+			}
+			if err != nil {
+				fmt.Printf("! %-8s %v\n", agent, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("  %-8s %s\n", agent, path)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(integrityCmd)
+	integrityCmd.AddCommand(integrityRecordCmd)
+	integrityCmd.AddCommand(integrityVerifyCmd)
+}
+
+const IntegrityFile string = "/etc/morio/integrity.json"
+
+// What an agent binary should be
+type IntegrityRecord struct {
+	// The path as configured or found, and the file it resolves to
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	SHA256 string `json:"sha256"`
+	// The package that owns the binary, and its package manager
+	Package        string    `json:"package,omitempty"`
+	PackageManager string    `json:"package_manager,omitempty"`
+	Recorded       time.Time `json:"recorded"`
+}
+
+func (record IntegrityRecord) Summary() string {
+	if record.Package != "" {
+		return record.Path + " (" + record.PackageManager + " package " + record.Package + ")"
+	}
+
+	return record.Path + " (sha256 " + record.SHA256 + ")"
+}
+
+func LoadIntegrityRecords() map[string]IntegrityRecord {
+	records := make(map[string]IntegrityRecord)
+	data, err := os.ReadFile(IntegrityFile)
+	if err != nil {
+		return records
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Unable to parse %s: %v\n", IntegrityFile, err)
+	}
+
+	return records
+}
+
+func SaveIntegrityRecords(records map[string]IntegrityRecord) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(IntegrityFile, data, 0644)
+}
+
+// Records what the binary at path is now
+func RecordBeat(path string) (IntegrityRecord, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return IntegrityRecord{}, err
+	}
+	if err := checkFileSafety(target); err != nil {
+		return IntegrityRecord{}, err
+	}
+	sum, err := sha256File(target)
+	if err != nil {
+		return IntegrityRecord{}, err
+	}
+	record := IntegrityRecord{Path: path, Target: target, SHA256: sum, Recorded: time.Now().UTC()}
+	record.PackageManager, record.Package = packageOwner(target)
+
+	return record, nil
+}
+
+// Verifies that the binary of an agent is safe to run
+func VerifyBeat(agent string, path string) error {
+	// The records are only as safe as the file that holds them
+	if err := checkFileSafety(IntegrityFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%s: %v", IntegrityFile, err)
+	}
+	record, ok := LoadIntegrityRecords()[agent]
+	if !ok {
+		return fmt.Errorf("no integrity record for %s, run 'morio integrity record %s'", agent, agent)
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	if path != record.Path || target != record.Target {
+		return fmt.Errorf("%s resolves to %s, but %s was recorded, run 'morio integrity record %s' if this is expected", path, target, record.Target, agent)
+	}
+	if err := checkFileSafety(target); err != nil {
+		return fmt.Errorf("%s: %v", target, err)
+	}
+
+	if record.Package != "" {
+		return verifyPackageFile(record.PackageManager, record.Package, target)
+	}
+	sum, err := sha256File(target)
+	if err != nil {
+		return err
+	}
+	if sum != record.SHA256 {
+		return fmt.Errorf("the checksum of %s changed since it was recorded on %s", target, record.Recorded.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Returned when the binary of an agent does not pass verification
+var errUnverifiedBeat = errors.New("refusing to run")
+
+// Returns the path to the binary of an agent, after verifying it
+// This is the only way to get the path to a binary that we run. With
+// insecure, the verification is skipped, with a warning.
+func VerifiedBeatPath(agent string, insecure bool) (string, error) {
+	path, _, err := FindBeat(agent)
+	if err != nil {
+		return "", err
+	}
+	if insecure {
+		fmt.Fprintf(os.Stderr, "Warning: Not verifying the integrity of %s\n", path)
+		return path, nil
+	}
+	if err := VerifyBeat(agent, path); err != nil {
+		return "", fmt.Errorf("%w %s: %v", errUnverifiedBeat, path, err)
+	}
+
+	return path, nil
+}
+
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Returns the package manager and package that own a file, if any
+// FIXME: Make this platform agnostic
+func packageOwner(path string) (string, string) {
+	if output, err := exec.Command("dpkg-query", "-S", path).Output(); err == nil {
+		// Like 'filebeat: /usr/share/filebeat/bin/filebeat'
+		if name, _, ok := strings.Cut(strings.TrimSpace(string(output)), ": "); ok && !strings.Contains(name, ",") {
+			return "dpkg", strings.TrimSpace(name)
+		}
+	}
+	if output, err := exec.Command("rpm", "-qf", "--queryformat", "%{NAME}", path).Output(); err == nil {
+		if name := strings.TrimSpace(string(output)); name != "" && !strings.Contains(name, " ") {
+			return "rpm", name
+		}
+	}
+
+	return "", ""
+}
+
+// Asks the package manager whether a file still matches its package
+// Both 'dpkg --verify' and 'rpm -V' only list files that differ, with a
+// 5 in the third column when the checksum differs.
+func verifyPackageFile(manager string, name string, path string) error {
+	var command *exec.Cmd
+	switch manager {
+	case "dpkg":
+		if err := exec.Command("dpkg-query", "-W", name).Run(); err != nil {
+			return fmt.Errorf("package %s that owned %s is no longer installed", name, path)
+		}
+		command = exec.Command("dpkg", "--verify", name)
+	case "rpm":
+		if err := exec.Command("rpm", "-q", name).Run(); err != nil {
+			return fmt.Errorf("package %s that owned %s is no longer installed", name, path)
+		}
+		command = exec.Command("rpm", "-V", name)
+	default:
+		return fmt.Errorf("unknown package manager %s", manager)
+	}
+	// These exit with an error when any file of the package differs,
+	// including config files, so we only look at the output.
+	output, _ := command.Output()
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[len(fields)-1] != path {
+			continue
+		}
+		if len(fields[0]) > 2 && fields[0][2] == '5' {
+			return fmt.Errorf("%s does not match package %s, its checksum changed", path, name)
+		}
+		if strings.Contains(line, "missing") {
+			return fmt.Errorf("%s is missing from package %s", path, name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Checks that a file is owned by root, and only writable by root
+func checkFileSafety(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unable to determine the owner")
+	}
+	if stat.Uid != 0 {
+		return fmt.Errorf("is owned by uid %d, not root", stat.Uid)
+	}
+	if info.Mode().Perm()&0002 != 0 {
+		return fmt.Errorf("is writable by all users (mode %s)", info.Mode().Perm())
+	}
+	if info.Mode().Perm()&0020 != 0 && stat.Gid != 0 {
+		return fmt.Errorf("is writable by group %d (mode %s)", stat.Gid, info.Mode().Perm())
+	}
+
+	return nil
+}
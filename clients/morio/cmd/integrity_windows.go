@@ -0,0 +1,15 @@
+//go:build windows
+
+package cmd
+
+import (
+	"os"
+)
+
+// Checks that a file is owned by root, and only writable by root
+// FIXME: Check the owner and ACL of the file on this platform
+func checkFileSafety(path string) error {
+	_, err := os.Stat(path)
+
+	return err
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A reference to another var (or a fact) in a var value, like ${MORIO_BROKER_HOST}
+// Use $${NAME} to write a literal ${NAME}.
+var varReference = regexp.MustCompile(`\$?\$\{([A-Za-z0-9_]+)\}`)
+
+// Returns the vars on this host, the facts, and the host tags. This is the
+// context that templates are rendered with. References in var values are
+// resolved for each template, see ResolveVars.
+func GetContext() (map[string]string, error) {
+	tags, err := LoadTags()
+	if err != nil {
+		return nil, err
+	}
+	context := ContextWithFacts(GetVars(), HostFacts())
+	for key, value := range TagVars(tags) {
+		context[key] = value
+	}
+
+	return context, nil
+}
+
+// Resolves ${NAME} references in the values of the vars with the given names
+// References can point to other vars, or to host facts. Only the given vars,
+// and the vars they reference, are resolved, so that a broken var does not
+// keep templates that do not use it from rendering.
+// References to names that are not a var or a fact are left as they are,
+// because the beats use the same syntax for environment variables and their
+// keystore. These are returned as warnings.
+// Returns a copy of the context, with the vars resolved.
+func ResolveVars(context map[string]string, names []string) (map[string]string, []string, error) {
+	resolved := make(map[string]string, len(context))
+	for key, value := range context {
+		resolved[key] = value
+	}
+	done := make(map[string]bool)
+	var warnings []string
+	// Names of the vars we are resolving, in order, to detect cycles
+	var stack []string
+
+	var resolve func(name string) error
+	resolve = func(name string) error {
+		value, ok := context[name]
+		// Facts, tags and run-time vars are used as they are
+		if !ok || done[name] || isFact(name) || isTagVar(name) || isRuntimeVar(name) {
+			return nil
+		}
+		for i, seen := range stack {
+			if seen == name {
+				return fmt.Errorf("var %s references itself: %s", name, strings.Join(append(stack[i:], name), " -> "))
+			}
+		}
+		stack = append(stack, name)
+		defer func() { stack = stack[:len(stack)-1] }()
+
+		var err error
+		result := varReference.ReplaceAllStringFunc(value, func(match string) string {
+			if err != nil {
+				return match
+			}
+			// Escaped reference
+			if strings.HasPrefix(match, "$$") {
+				return match[1:]
+			}
+			reference := varReference.FindStringSubmatch(match)[1]
+			if _, ok := context[reference]; !ok {
+				warnings = append(warnings, fmt.Sprintf("var %s references ${%s}, which is not a var or fact, leaving it as is", name, reference))
+				return match
+			}
+			err = resolve(reference)
+			return resolved[reference]
+		})
+		if err != nil {
+			return err
+		}
+		resolved[name] = result
+		done[name] = true
+
+		return nil
+	}
+
+	for _, name := range names {
+		if err := resolve(name); err != nil {
+			return nil, warnings, err
+		}
+	}
+
+	return resolved, warnings, nil
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// morio vars history
+var historyCmd = &cobra.Command{
+	Use:   "history [NAME]",
+	Short: "Show the history of var changes",
+	Long: `Shows all changes made to custom template variables (vars),
+or only those made to var NAME.
+
+Every change made through the morio client is recorded in an append-only
+journal, along with the time, the user who made it, and the old and new
+value. Use the number in the first column with 'morio vars revert'.`,
+	Args: cobra.MaximumNArgs(1),
+	Example: `  morio vars history
+  morio vars history MORIO_TICK`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := ""
+		if len(args) > 0 {
+			name = args[0]
+		}
+		ShowVarHistory(name)
+	},
+}
+
+// morio vars revert
+var revertCmd = &cobra.Command{
+	Use:   "revert NAME --to n",
+	Short: "Revert a var to an earlier value",
+	Long: `Restores the value that var NAME had right after change n.
+Run 'morio vars history NAME' to find the change number.
+
+If change n removed the custom value, the custom value is removed again.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio vars revert MORIO_TICK --to 12",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := RevertVar(args[0], revertTo); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var revertTo int
+
+func init() {
+	varsCmd.AddCommand(historyCmd)
+	varsCmd.AddCommand(revertCmd)
+	revertCmd.Flags().IntVar(&revertTo, "to", 0, "The number of the change to revert to")
+	revertCmd.MarkFlagRequired("to")
+}
+
+// Location of the journal of var changes
+// FIXME: Make this platform agnostic
+const VarJournalFile string = "/etc/morio/vars.journal"
+
+// A change to a custom var
+// Old and New are nil when there was, or is, no custom value.
+type VarJournalEntry struct {
+	Seq    int       `json:"seq"`
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Action string    `json:"action"`
+	Name   string    `json:"name"`
+	Old    *string   `json:"old"`
+	New    *string   `json:"new"`
+}
+
+// Writes a custom var, and records the change in the journal
+func ChangeVar(action string, key string, value string) error {
+	old := customVarValue(key)
+	if err := SetVar(key, value); err != nil {
+		return err
+	}
+	if old == nil || *old != value {
+		RecordVarChange(action, key, old, &value)
+	}
+
+	return nil
+}
+
+// Removes a custom var, and records the change in the journal
+func RemoveVar(action string, key string) error {
+	old := customVarValue(key)
+	if err := RmVar(key); err != nil {
+		return err
+	}
+	if old != nil {
+		RecordVarChange(action, key, old, nil)
+	}
+
+	return nil
+}
+
+func customVarValue(key string) *string {
+	data, err := os.ReadFile(CustomVarFolder + "/" + key)
+	if err != nil {
+		return nil
+	}
+	value := string(data)
+
+	return &value
+}
+
+// Appends a change to the journal
+// The journal is locked while we append, so that the client and the daemon
+// do not record changes with the same number.
+func RecordVarChange(action string, key string, old *string, new *string) {
+	file, err := os.OpenFile(VarJournalFile, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Unable to record var change in %s: %v\n", VarJournalFile, err)
+		return
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Unable to record var change in %s: %v\n", VarJournalFile, err)
+		return
+	}
+	defer unlockFile(file)
+
+	entry := VarJournalEntry{
+		Seq:    lastJournalSeq(file) + 1,
+		Time:   time.Now().UTC(),
+		User:   journalUser(),
+		Action: action,
+		Name:   key,
+		Old:    old,
+		New:    new,
+	}
+	data, err := json.Marshal(entry)
+	check(err)
+	file.Write(append(data, '\n'))
+}
+
+// Returns the number of the last change in the journal, or 0
+// Reads the journal from the end, skipping lines that do not parse.
+func lastJournalSeq(file *os.File) int {
+	info, err := file.Stat()
+	if err != nil {
+		return 0
+	}
+	end := info.Size()
+	// What is left of the line we did not read the start of
+	var partial []byte
+	for end > 0 {
+		size := min(end, 4096)
+		end -= size
+		chunk := make([]byte, size, int(size)+len(partial))
+		if _, err := file.ReadAt(chunk, end); err != nil {
+			return 0
+		}
+		lines := bytes.Split(append(chunk, partial...), []byte("\n"))
+		for i := len(lines) - 1; i > 0 || (i == 0 && end == 0); i-- {
+			var entry VarJournalEntry
+			if json.Unmarshal(lines[i], &entry) == nil && entry.Seq > 0 {
+				return entry.Seq
+			}
+		}
+		partial = lines[0]
+	}
+
+	return 0
+}
+
+// Returns the user who is making changes, looking through sudo
+func journalUser() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+
+	return "unknown"
+}
+
+func LoadVarJournal() []VarJournalEntry {
+	var entries []VarJournalEntry
+	file, err := os.Open(VarJournalFile)
+	if err != nil {
+		return entries
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry VarJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+func ShowVarHistory(name string) {
+	found := false
+	for _, entry := range LoadVarJournal() {
+		if name != "" && entry.Name != name {
+			continue
+		}
+		if !found {
+			fmt.Printf("%5s  %-20s  %-12s  %-8s  %-24s  %s\n", "#", "TIME", "USER", "ACTION", "NAME", "CHANGE")
+			found = true
+		}
+		fmt.Printf("%5d  %-20s  %-12s  %-8s  %-24s  %s -> %s\n",
+			entry.Seq, entry.Time.Format("2006-01-02 15:04:05Z"), entry.User, entry.Action, entry.Name,
+			journalValue(entry.Old), journalValue(entry.New))
+	}
+	if !found {
+		fmt.Println("No changes recorded")
+	}
+}
+
+func journalValue(value *string) string {
+	if value == nil {
+		return "(unset)"
+	}
+
+	return strconv.Quote(*value)
+}
+
+// Restores the value a var had right after a given change
+func RevertVar(name string, seq int) error {
+	for _, entry := range LoadVarJournal() {
+		if entry.Seq != seq {
+			continue
+		}
+		if entry.Name != name {
+			return fmt.Errorf("change %d was made to %s, not %s", seq, entry.Name, name)
+		}
+		var err error
+		if entry.New == nil {
+			err = RemoveVar("revert", name)
+		} else {
+			err = ChangeVar("revert", name, *entry.New)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reverted %s to %s\n", name, journalValue(entry.New))
+		return nil
+	}
+
+	return fmt.Errorf("there is no change %d in the journal", seq)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+
+package cmd
+
+import (
+	"os"
+)
+
+// Takes an exclusive lock on a file, waiting for other processes to release it
+// FIXME: Lock the file on this platform
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// morio keystore
+var keystoreCmd = &cobra.Command{
+	Use:   "keystore",
+	Short: "Manage the agent keystores",
+	Long: `Manages the keystores of the agents, which hold secrets like passwords
+and API keys. This wraps the keystore of each beat, using the Morio
+configuration of the agent.
+
+Templates can reference a secret as ${KEY}, and the agent will replace it
+at run-time. This keeps secrets out of vars.d and the rendered configuration.
+Var values can reference a secret as ${KEY} too, as long as there is no
+var or fact named KEY. Write $${KEY} to make sure it is passed on as it is.
+
+Use --agent to manage the keystore of a single agent. Without it, all
+agents are managed at once.`,
+}
+
+// morio keystore add
+var keystoreAddCmd = &cobra.Command{
+	Use:   "add KEY",
+	Short: "Add a secret to the keystore",
+	Long: `Adds a secret to the keystore of the agents.
+You will be prompted for the value, unless you use --stdin.`,
+	Args: cobra.ExactArgs(1),
+	Example: `  morio keystore add ES_PASSWORD
+  echo -n "$TOKEN" | morio keystore add API_TOKEN --stdin --agent metrics`,
+	Run: func(cmd *cobra.Command, args []string) {
+		agents := keystoreAgentsFromFlag()
+		var value string
+		if keystoreStdin {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		} else {
+			value = readSecret("Enter value for " + args[0] + ": ")
+		}
+		failed := false
+		for _, agent := range agents {
+			if err := KeystoreAdd(agent, args[0], value, keystoreForce); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Unable to add %s to the %s keystore: %v\n", args[0], agent, err)
+				failed = true
+				continue
+			}
+			fmt.Println("Added " + args[0] + " to the " + agent + " keystore")
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// morio keystore list
+var keystoreListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the keys in the keystore",
+	Long:  `Lists the keys in the keystore of the agents. Values are never shown.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		failed := false
+		for _, agent := range keystoreAgentsFromFlag() {
+			keys, err := KeystoreList(agent)
+			fmt.Println(agent + " (" + agentBeatName(agent) + "):")
+			if errors.Is(err, errNoKeystore) {
+				fmt.Println("  No keystore")
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "  Error: %v\n", err)
+				failed = true
+				continue
+			}
+			if len(keys) == 0 {
+				fmt.Println("  No keys")
+			}
+			for _, key := range keys {
+				fmt.Println("  " + key)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// morio keystore rm
+var keystoreRmCmd = &cobra.Command{
+	Use:     "rm KEY",
+	Short:   "Remove a secret from the keystore",
+	Long:    `Removes a secret from the keystore of the agents.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio keystore rm ES_PASSWORD --agent logs",
+	Run: func(cmd *cobra.Command, args []string) {
+		failed := false
+		for _, agent := range keystoreAgentsFromFlag() {
+			if err := KeystoreRm(agent, args[0]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: Unable to remove %s from the %s keystore: %v\n", args[0], agent, err)
+				failed = true
+				continue
+			}
+			fmt.Println("Removed " + args[0] + " from the " + agent + " keystore")
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+var keystoreAgent string
+var keystoreStdin bool
+var keystoreForce bool
+
+func init() {
+	RootCmd.AddCommand(keystoreCmd)
+	keystoreCmd.AddCommand(keystoreAddCmd)
+	keystoreCmd.AddCommand(keystoreListCmd)
+	keystoreCmd.AddCommand(keystoreRmCmd)
+	keystoreCmd.PersistentFlags().StringVar(&keystoreAgent, "agent", "", "Only manage the keystore of this agent (audit, logs, or metrics)")
+	keystoreAddCmd.Flags().BoolVar(&keystoreStdin, "stdin", false, "Read the value from stdin")
+	keystoreAddCmd.Flags().BoolVar(&keystoreForce, "force", false, "Overwrite the key if it already exists")
+}
+
+// Returns the agents to manage, based on the --agent flag
+func keystoreAgentsFromFlag() []string {
+	switch keystoreAgent {
+	case "":
+		return Agents
+	case "audit", "logs", "metrics":
+		return []string{keystoreAgent}
+	}
+	fmt.Fprintf(os.Stderr, "Error: Unknown agent %s, use audit, logs, or metrics\n", keystoreAgent)
+	os.Exit(1)
+
+	return nil
+}
+
+var errNoKeystore = errors.New("the keystore does not exist")
+
+// Runs '<beat> keystore' with the Morio configuration of the agent
+func runKeystore(agent string, stdin io.Reader, args ...string) (string, error) {
+	path, err := VerifiedBeatPath(agent, false)
+	if err != nil {
+		return "", err
+	}
+	command := exec.Command(path, append([]string{"-c", GetConfigPath(agent, "config.yaml"), "keystore"}, args...)...)
+	command.Stdin = stdin
+	var output bytes.Buffer
+	command.Stdout = &output
+	command.Stderr = &output
+	err = command.Run()
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) && isMissingKeystore(output.String()) {
+		return output.String(), errNoKeystore
+	}
+	if err != nil && strings.TrimSpace(output.String()) != "" {
+		err = fmt.Errorf("%s", strings.TrimSpace(output.String()))
+	}
+
+	return output.String(), err
+}
+
+// Whether the beat failed because the keystore was never created
+func isMissingKeystore(output string) bool {
+	output = strings.ToLower(output)
+
+	return strings.Contains(output, "keystore does not exist") || strings.Contains(output, "keystore doesn't exist")
+}
+
+func KeystoreList(agent string) ([]string, error) {
+	output, err := runKeystore(agent, nil, "list")
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(output, "\n") {
+		if key := strings.TrimSpace(line); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func KeystoreAdd(agent string, key string, value string, force bool) error {
+	keys, err := KeystoreList(agent)
+	switch {
+	case errors.Is(err, errNoKeystore):
+		if _, err := runKeystore(agent, nil, "create"); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case contains(keys, key) && !force:
+		return fmt.Errorf("key already exists, use --force to overwrite it")
+	}
+	_, err = runKeystore(agent, strings.NewReader(value), "add", key, "--stdin", "--force")
+	if errors.Is(err, errNoKeystore) {
+		// Some beats only notice when adding
+		if _, err := runKeystore(agent, nil, "create"); err != nil {
+			return err
+		}
+		_, err = runKeystore(agent, strings.NewReader(value), "add", key, "--stdin", "--force")
+	}
+
+	return err
+}
+
+func KeystoreRm(agent string, key string) error {
+	_, err := runKeystore(agent, nil, "remove", key)
+
+	return err
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import "testing"
+
+func TestIsMissingKeystore(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"Error: the keystore doesn't exist. Use the 'create' command to create one", true},
+		{"The keystore does not exist", true},
+		{"open /var/lib/filebeat/filebeat.keystore: permission denied", false},
+		{"could not read values from the keystore, error: invalid password", false},
+		{"Error: could not create the keystore", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isMissingKeystore(test.output); got != test.want {
+			t.Errorf("isMissingKeystore(%q) = %v, want %v", test.output, got, test.want)
+		}
+	}
+}
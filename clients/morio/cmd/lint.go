@@ -0,0 +1,507 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// morio template lint
+var templateLintCmd = &cobra.Command{
+	Use:   "lint [template-path...]",
+	Short: "Check templates for mistakes",
+	Long: `Checks templates for mistakes in their MORIO_DOCS metadata and mustache usage.
+
+This checks that:
+  - All mustache sections are balanced
+  - The MORIO_DOCS block parses as YAML, and has an 'about' entry
+  - Every var used is declared in vars.local or vars.global
+  - Every var in vars.global exists in global-vars.yaml
+  - Default values match the declared var types
+
+Without arguments, all templates on this host are checked.
+This command exits with status 1 if any errors are found.`,
+	Example: `  morio template lint
+  morio template lint logs/module-templates.d/nginx.yaml`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var diagnostics []LintDiagnostic
+		if len(args) == 0 {
+			diagnostics = LintAllTemplates()
+		} else {
+			globals := LoadGlobalVars()
+			for _, arg := range args {
+				for _, path := range templateFilesIn(resolveTemplatePath(arg)) {
+					diagnostics = append(diagnostics, LintTemplate(path, !strings.HasSuffix(path, ".mustache"), globals)...)
+				}
+			}
+		}
+		errors := ShowLintDiagnostics(diagnostics)
+		if errors > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	templateCmd.AddCommand(templateLintCmd)
+}
+
+// A problem found in a template
+type LintDiagnostic struct {
+	File     string
+	Line     int
+	Severity string // error or warning
+	Message  string
+}
+
+func (d LintDiagnostic) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", d.File, d.Line, d.Severity, d.Message)
+}
+
+// The types a var can be declared as
+var varTypes = []string{"string", "bool", "int", "number", "list", "map"}
+
+// Lints global-vars.yaml and all templates on this host
+func LintAllTemplates() []LintDiagnostic {
+	diagnostics := LintGlobalVars()
+	globals := LoadGlobalVars()
+	for _, target := range TemplateTargets {
+		path := GetConfigPath(target.From)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		for _, file := range templateFilesIn(path) {
+			diagnostics = append(diagnostics, LintTemplate(file, target.Folder, globals)...)
+		}
+	}
+
+	return diagnostics
+}
+
+// Checks that the defaults in global-vars.yaml match their declared type
+func LintGlobalVars() []LintDiagnostic {
+	var diagnostics []LintDiagnostic
+	path := GetConfigPath("global-vars.yaml")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return append(diagnostics, LintDiagnostic{path, 0, "error", err.Error()})
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return append(diagnostics, LintDiagnostic{path, yamlErrorLine(err, 1), "error", err.Error()})
+	}
+	var globals map[string]interface{}
+	root.Decode(&globals)
+	lines := yamlKeyLines(&root, "")
+	for _, name := range sortedKeys(globals) {
+		entry, ok := globals[name].(map[string]interface{})
+		if !ok {
+			diagnostics = append(diagnostics, LintDiagnostic{path, lines[name], "error", "global var " + name + " should have an 'about' and a 'default'"})
+			continue
+		}
+		if _, ok := entry["about"]; !ok {
+			diagnostics = append(diagnostics, LintDiagnostic{path, lines[name], "warning", "global var " + name + " has no 'about'"})
+		}
+		if message := checkVarType(name, entry["type"], entry["default"]); message != "" {
+			diagnostics = append(diagnostics, LintDiagnostic{path, lines[name+".default"], "error", message})
+		}
+	}
+
+	return diagnostics
+}
+
+// Lints a single template
+// Templates for modules, inputs, and rules require a MORIO_DOCS block,
+// the agent configuration templates do not.
+func LintTemplate(path string, requireDocs bool, globals map[string]interface{}) []LintDiagnostic {
+	var diagnostics []LintDiagnostic
+	add := func(line int, severity string, message string) {
+		diagnostics = append(diagnostics, LintDiagnostic{path, line, severity, message})
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		add(0, "error", err.Error())
+		return diagnostics
+	}
+	text := string(data)
+	tags, problems := scanTemplateTags(text)
+	for _, problem := range problems {
+		add(problem.Line, "error", problem.Name)
+	}
+
+	// Check that sections are balanced, and find the MORIO_DOCS block
+	var stack []templateTag
+	var docsOpen, docsClose *templateTag
+	for i := range tags {
+		tag := tags[i]
+		switch tag.Kind {
+		case '#', '^':
+			stack = append(stack, tag)
+		case '/':
+			if len(stack) == 0 {
+				add(tag.Line, "error", "section "+tag.Name+" is closed, but was never opened")
+				continue
+			}
+			open := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if open.Name != tag.Name {
+				add(tag.Line, "error", fmt.Sprintf("section %s opened on line %d is closed by %s", open.Name, open.Line, tag.Name))
+			}
+			if open.Name == "MORIO_DOCS" && open.Kind == '#' && docsOpen == nil {
+				docsOpen = &open
+				docsClose = &tags[i]
+			}
+		}
+	}
+	for _, open := range stack {
+		add(open.Line, "error", "section "+open.Name+" is never closed")
+	}
+
+	if docsOpen == nil {
+		if requireDocs {
+			add(1, "error", "template has no MORIO_DOCS block")
+		}
+		return diagnostics
+	}
+
+	// Parse the MORIO_DOCS block as YAML
+	block := text[docsOpen.End:docsClose.Start]
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(block), &root); err != nil {
+		add(docsOpen.Line+yamlErrorLine(err, 1)-1, "error", "MORIO_DOCS does not parse: "+err.Error())
+		return diagnostics
+	}
+	// Rendering would fail on the errors we found so far
+	if len(diagnostics) > 0 {
+		return diagnostics
+	}
+	if _, err := ParseTemplateDocs(path); err != nil {
+		add(1, "error", "template does not parse when rendered with MORIO_DOCS (is all other content in a {{^MORIO_DOCS}} section?): "+err.Error())
+	}
+	var docs map[string]interface{}
+	root.Decode(&docs)
+	lines := yamlKeyLines(&root, "")
+	line := func(key string) int {
+		if n, ok := lines[key]; ok {
+			return docsOpen.Line + n - 1
+		}
+		return docsOpen.Line
+	}
+
+	if about, ok := docs["about"].(string); !ok || strings.TrimSpace(about) == "" {
+		add(docsOpen.Line, "error", "MORIO_DOCS has no 'about' entry")
+	}
+
+	// Work out what vars are declared
+	declared := make(map[string]bool)
+	types := make(map[string]interface{})
+	vars, _ := docs["vars"].(map[string]interface{})
+	local, _ := vars["local"].(map[string]interface{})
+	for name, declaration := range local {
+		declared[name] = true
+		if entry, ok := declaration.(map[string]interface{}); ok {
+			types[name] = entry["type"]
+		}
+	}
+	for _, name := range docsList(vars["global"]) {
+		declared[name] = true
+		entry, ok := globals[name].(map[string]interface{})
+		if !ok {
+			add(line("vars.global."+name), "error", "global var "+name+" is not declared in global-vars.yaml")
+			continue
+		}
+		types[name] = entry["type"]
+	}
+	defaults, _ := vars["defaults"].(map[string]interface{})
+	for _, name := range sortedKeys(defaults) {
+		if !declared[name] {
+			add(line("vars.defaults."+name), "warning", "default for "+name+", which is not declared in vars.local or vars.global")
+		}
+		if message := checkVarType(name, types[name], defaults[name]); message != "" {
+			add(line("vars.defaults."+name), "error", message)
+		}
+	}
+	for _, name := range sortedKeys(types) {
+		if types[name] != nil && defaults[name] == nil {
+			if message := checkVarType(name, types[name], nil); message != "" {
+				add(line("vars.local."+name), "error", message)
+			}
+		}
+	}
+
+	// Check that all vars used outside of MORIO_DOCS are declared
+	// Inside a section over a list or map, names refer to its items instead.
+	reported := make(map[string]bool)
+	var sections []bool
+	for _, tag := range tags {
+		if tag.Start >= docsOpen.Start && tag.End <= docsClose.End {
+			continue
+		}
+		items := false
+		for _, iterating := range sections {
+			items = items || iterating
+		}
+		switch tag.Kind {
+		case '#', '^':
+			value := defaults[tag.Name]
+			if entry, ok := globals[tag.Name].(map[string]interface{}); ok && value == nil {
+				value = entry["default"]
+			}
+			kind := fmt.Sprintf("%v", types[tag.Name])
+			_, isList := value.([]interface{})
+			_, isMap := value.(map[string]interface{})
+			sections = append(sections, kind == "list" || kind == "map" || isList || isMap || isTagVar(tag.Name))
+		case '/':
+			if len(sections) > 0 {
+				sections = sections[:len(sections)-1]
+			}
+			continue
+		case 0, '{', '&':
+		default:
+			continue
+		}
+		name := strings.Split(tag.Name, ".")[0]
+		if name == "" || name == "MORIO_DOCS" || isRuntimeVar(name) || isFact(name) || isTagVar(name) || declared[name] || reported[name] || items {
+			continue
+		}
+		reported[name] = true
+		add(tag.Line, "error", "var "+name+" is used, but not declared in vars.local or vars.global")
+	}
+
+	return diagnostics
+}
+
+// Returns a message if the value does not match the declared type
+func checkVarType(name string, declared interface{}, value interface{}) string {
+	if declared == nil {
+		return ""
+	}
+	kind := fmt.Sprintf("%v", declared)
+	known := false
+	for _, t := range varTypes {
+		if kind == t {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Sprintf("var %s has unknown type %s (should be one of %s)", name, kind, strings.Join(varTypes, ", "))
+	}
+	if value == nil {
+		return ""
+	}
+
+	ok := false
+	switch kind {
+	case "string":
+		// Vars are stored as strings, so any scalar will do
+		switch value.(type) {
+		case []interface{}, map[string]interface{}:
+		default:
+			ok = true
+		}
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			ok = true
+		case string:
+			_, err := strconv.ParseBool(v)
+			ok = err == nil
+		}
+	case "int":
+		switch v := value.(type) {
+		case int:
+			ok = true
+		case string:
+			_, err := strconv.Atoi(v)
+			ok = err == nil
+		}
+	case "number":
+		switch v := value.(type) {
+		case int, float64:
+			ok = true
+		case string:
+			_, err := strconv.ParseFloat(v, 64)
+			ok = err == nil
+		}
+	case "list":
+		_, ok = value.([]interface{})
+	case "map":
+		_, ok = value.(map[string]interface{})
+	}
+	if !ok {
+		return fmt.Sprintf("default for %s is %v, which is not of type %s", name, value, kind)
+	}
+
+	return ""
+}
+
+// A mustache tag as found in the template source
+type templateTag struct {
+	// 0 for variables, or the sigil of the tag: # ^ / ! > & { =
+	Kind  byte
+	Name  string
+	Line  int
+	Start int
+	End   int
+}
+
+// Finds all mustache tags in a template, keeping track of where they are
+// Problems are returned as tags with the message as name.
+func scanTemplateTags(text string) ([]templateTag, []templateTag) {
+	var tags, problems []templateTag
+	open, close := "{{", "}}"
+	pos := 0
+	for {
+		i := strings.Index(text[pos:], open)
+		if i < 0 {
+			break
+		}
+		start := pos + i
+		inner := start + len(open)
+		closeTag := close
+		triple := open == "{{" && strings.HasPrefix(text[inner:], "{")
+		if triple {
+			closeTag = "}" + close
+		}
+		j := strings.Index(text[inner:], closeTag)
+		if j < 0 {
+			problems = append(problems, templateTag{Name: "tag is never closed", Line: lineAt(text, start)})
+			break
+		}
+		end := inner + j + len(closeTag)
+		body := strings.TrimSpace(text[inner : inner+j])
+		tag := templateTag{Line: lineAt(text, start), Start: start, End: end}
+		switch {
+		case triple:
+			tag.Kind = '{'
+			tag.Name = strings.TrimSpace(body[1:])
+		case body != "" && strings.ContainsRune("#^/!>&=", rune(body[0])):
+			tag.Kind = body[0]
+			tag.Name = strings.TrimSpace(body[1:])
+		default:
+			tag.Name = body
+		}
+		if tag.Kind == '=' {
+			// Set delimiters, as in {{=<% %>=}}
+			delimiters := strings.Fields(strings.TrimSuffix(tag.Name, "="))
+			if len(delimiters) != 2 {
+				problems = append(problems, templateTag{Name: "invalid set delimiter tag", Line: tag.Line})
+			} else {
+				open, close = delimiters[0], delimiters[1]
+			}
+		}
+		if tag.Kind != '!' && tag.Kind != '=' && tag.Name == "" {
+			problems = append(problems, templateTag{Name: "empty tag", Line: tag.Line})
+		}
+		tags = append(tags, tag)
+		pos = end
+	}
+
+	return tags, problems
+}
+
+func lineAt(text string, offset int) int {
+	return strings.Count(text[:offset], "\n") + 1
+}
+
+var yamlLineRegex = regexp.MustCompile(`line (\d+)`)
+
+// Extracts the line number from a YAML error
+func yamlErrorLine(err error, fallback int) int {
+	match := yamlLineRegex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return fallback
+	}
+	line, _ := strconv.Atoi(match[1])
+
+	return line
+}
+
+// Returns the line of every key in a YAML document, as dotted paths
+func yamlKeyLines(node *yaml.Node, prefix string) map[string]int {
+	lines := make(map[string]int)
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		return yamlKeyLines(node.Content[0], prefix)
+	}
+	if node.Kind == yaml.SequenceNode {
+		// Scalar list items are keyed by their value
+		for _, item := range node.Content {
+			if item.Kind == yaml.ScalarNode {
+				lines[prefix+item.Value] = item.Line
+			}
+		}
+		return lines
+	}
+	if node.Kind != yaml.MappingNode {
+		return lines
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := prefix + node.Content[i].Value
+		lines[key] = node.Content[i].Line
+		for nested, line := range yamlKeyLines(node.Content[i+1], key+".") {
+			lines[nested] = line
+		}
+	}
+
+	return lines
+}
+
+// Returns the templates in a folder, or the path itself if it is a file
+func templateFilesIn(path string) []string {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return []string{path}
+	}
+	var files []string
+	entries, _ := os.ReadDir(path)
+	for _, entry := range entries {
+		suffix := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (suffix == ".yaml" || suffix == ".disabled" || suffix == ".mustache") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+
+	return files
+}
+
+// Template paths can be relative to the current folder, or to the config folder
+func resolveTemplatePath(path string) string {
+	if _, err := os.Stat(path); err == nil {
+		if absolute, err := filepath.Abs(path); err == nil {
+			return absolute
+		}
+	}
+
+	return GetConfigPath(path)
+}
+
+// Prints the diagnostics and returns the number of errors
+func ShowLintDiagnostics(diagnostics []LintDiagnostic) int {
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].File != diagnostics[j].File {
+			return diagnostics[i].File < diagnostics[j].File
+		}
+		return diagnostics[i].Line < diagnostics[j].Line
+	})
+	errors := 0
+	for _, diagnostic := range diagnostics {
+		fmt.Println(diagnostic)
+		if diagnostic.Severity == "error" {
+			errors++
+		}
+	}
+	if len(diagnostics) == 0 {
+		fmt.Println("No problems found")
+	} else {
+		fmt.Printf("\n%d errors, %d warnings\n", errors, len(diagnostics)-errors)
+	}
+
+	return errors
+}
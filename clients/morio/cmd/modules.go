@@ -5,9 +5,18 @@ import (
 	"github.com/spf13/cobra"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
+// Folders holding module templates for the various agents
+var moduleFolders = []string{
+	"audit/module-templates.d",
+	"logs/input-templates.d",
+	"logs/module-templates.d",
+	"metrics/module-templates.d",
+}
+
 // morio modules
 var modulesCmd = &cobra.Command{
 	Use:   "modules",
@@ -20,9 +29,33 @@ This allows you to manage Morio client modules which will be applied to all agen
 var modulesListCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List modules",
-	Long:  `List client modules.`,
+	Long: `List client modules.
+
+Each module is listed once, along with its status, the agents it
+touches, and its description. A module is 'partial' when it is
+enabled for some agents, but not for others.`,
+	Example: `  morio modules list
+  morio modules list --tag security --enabled`,
 	Run: func(cmd *cobra.Command, args []string) {
-		ShowModulesList()
+		ShowCatalog(FilterCatalog(ModuleCatalog(), catalogFilterFromFlags()))
+	},
+}
+
+// morio modules search
+var modulesSearchCmd = &cobra.Command{
+	Use:   "search [term]",
+	Short: "Search modules",
+	Long: `Searches client modules.
+
+The search term is matched against the name, description, category,
+tags, and platforms of each module. All words must match.`,
+	Args: cobra.MinimumNArgs(1),
+	Example: `  morio modules search nginx
+  morio modules search web server --disabled`,
+	Run: func(cmd *cobra.Command, args []string) {
+		filter := catalogFilterFromFlags()
+		filter.Term = strings.Join(args, " ")
+		ShowCatalog(FilterCatalog(ModuleCatalog(), filter))
 	},
 }
 
@@ -62,6 +95,44 @@ var modulesInfoCmd = &cobra.Command{
 	},
 }
 
+// morio modules suggest
+var modulesSuggestCmd = &cobra.Command{
+	Use:   "suggest",
+	Short: "Suggest modules for this host",
+	Long: `Inspects this host and suggests modules to enable.
+
+The running processes, listening ports, installed packages, and
+files on this host are matched against the 'detect' rules in the
+MORIO_DOCS block of each module template.
+
+Use --apply to enable all suggested modules in one step.`,
+	Example: `  morio modules suggest
+  morio modules suggest --apply`,
+	Run: func(cmd *cobra.Command, args []string) {
+		suggestions := ModuleSuggestions(InspectHost())
+		ShowModuleSuggestions(suggestions)
+		if suggestApply {
+			applied := 0
+			for _, suggestion := range suggestions {
+				if !suggestion.Enabled {
+					enableModule(suggestion.Name)
+					applied++
+				}
+			}
+			if applied > 0 {
+				fmt.Println()
+				ShowModulesList()
+			}
+		}
+	},
+}
+
+var suggestApply bool
+var catalogTags []string
+var catalogCategory string
+var catalogEnabled bool
+var catalogDisabled bool
+
 func init() {
 	// Add the commands
 	RootCmd.AddCommand(modulesCmd)
@@ -69,38 +140,34 @@ func init() {
 	modulesCmd.AddCommand(modulesEnableCmd)
 	modulesCmd.AddCommand(modulesDisableCmd)
 	modulesCmd.AddCommand(modulesInfoCmd)
+	modulesCmd.AddCommand(modulesSuggestCmd)
+	modulesCmd.AddCommand(modulesSearchCmd)
+
+	// Flags
+	modulesSuggestCmd.Flags().BoolVar(&suggestApply, "apply", false, "Enable all suggested modules")
+	for _, cmd := range []*cobra.Command{modulesListCmd, modulesSearchCmd} {
+		cmd.Flags().StringArrayVar(&catalogTags, "tag", nil, "Only show modules with this tag (can be repeated)")
+		cmd.Flags().StringVar(&catalogCategory, "category", "", "Only show modules in this category")
+		cmd.Flags().BoolVar(&catalogEnabled, "enabled", false, "Only show enabled modules")
+		cmd.Flags().BoolVar(&catalogDisabled, "disabled", false, "Only show disabled modules")
+		cmd.MarkFlagsMutuallyExclusive("enabled", "disabled")
+	}
 }
 
-func ShowModuleList(agent string) {
-	enabled, disabled := ModuleList(agent + "/module-templates.d")
-	if agent == "logs" {
-		enabledInputs, disabledInputs := ModuleList(agent + "/input-templates.d")
-		enabled = joinUnique(enabled, enabledInputs)
-		disabled = joinUnique(disabled, disabledInputs)
-	}
-	if len(enabled) == 0 {
-		fmt.Println("No " + agent + " modules enabled")
-	} else {
-		fmt.Println("Enabled " + agent + " modules:")
-		for _, name := range enabled {
-			fmt.Println(" - " + ModuleNameFromFile(name))
-		}
+func catalogFilterFromFlags() CatalogFilter {
+	filter := CatalogFilter{Tags: catalogTags, Category: catalogCategory}
+	if catalogEnabled {
+		filter.Status = "enabled"
 	}
-	if len(disabled) == 0 {
-		fmt.Println("No " + agent + " modules disabled")
-	} else {
-		fmt.Println("Disabled " + agent + " modules:")
-		for _, name := range disabled {
-			fmt.Println(" - " + ModuleNameFromFile(name))
-		}
+	if catalogDisabled {
+		filter.Status = "disabled"
 	}
-	fmt.Println()
+
+	return filter
 }
 
 func ShowModulesList() {
-	ShowModuleList("audit")
-	ShowModuleList("logs")
-	ShowModuleList("metrics")
+	ShowCatalog(ModuleCatalog())
 }
 
 func ModuleList(folder string) ([]string, []string) {
@@ -187,7 +254,7 @@ func disableModuleFile(base, module string) {
 }
 
 func ModuleNameFromFile(file string) string {
-  baseFile := filepath.Base(file)
+	baseFile := filepath.Base(file)
 	base := baseFile[:len(baseFile)-len(filepath.Ext(baseFile))]
 	// Disabled modules have a double extension
 	if strings.HasSuffix(base, ".yaml") {
@@ -319,3 +386,71 @@ func joinUnique(slice1, slice2 []string) []string {
 
 	return result
 }
+
+// A module that was detected on this host
+type ModuleSuggestion struct {
+	Name    string
+	Reasons []string
+	Enabled bool
+}
+
+// Matches the detect rules of all module templates against the host
+func ModuleSuggestions(host HostInventory) []ModuleSuggestion {
+	found := make(map[string]*ModuleSuggestion)
+	for _, folder := range moduleFolders {
+		enabled, disabled := ModuleList(folder)
+		for _, file := range append(enabled, disabled...) {
+			reasons := DetectModule(TemplateDocsAsYaml(folder+"/"+file), host)
+			if len(reasons) == 0 {
+				continue
+			}
+			name := ModuleNameFromFile(file)
+			suggestion, ok := found[name]
+			if !ok {
+				suggestion = &ModuleSuggestion{Name: name, Enabled: true}
+				found[name] = suggestion
+			}
+			suggestion.Reasons = joinUnique(suggestion.Reasons, reasons)
+			// A module is only enabled when it is enabled for all agents
+			if filepath.Ext(file) == ".disabled" {
+				suggestion.Enabled = false
+			}
+		}
+	}
+
+	suggestions := make([]ModuleSuggestion, 0, len(found))
+	for _, suggestion := range found {
+		sort.Strings(suggestion.Reasons)
+		suggestions = append(suggestions, *suggestion)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		return suggestions[i].Name < suggestions[j].Name
+	})
+
+	return suggestions
+}
+
+func ShowModuleSuggestions(suggestions []ModuleSuggestion) {
+	var suggested, enabled []ModuleSuggestion
+	for _, suggestion := range suggestions {
+		if suggestion.Enabled {
+			enabled = append(enabled, suggestion)
+		} else {
+			suggested = append(suggested, suggestion)
+		}
+	}
+	if len(suggested) == 0 {
+		fmt.Println("No modules to suggest for this host")
+	} else {
+		fmt.Println("Suggested modules:")
+		for _, suggestion := range suggested {
+			fmt.Println(" - " + suggestion.Name + " (" + strings.Join(suggestion.Reasons, ", ") + ")")
+		}
+	}
+	if len(enabled) > 0 {
+		fmt.Println("Detected modules that are already enabled:")
+		for _, suggestion := range enabled {
+			fmt.Println(" - " + suggestion.Name + " (" + strings.Join(suggestion.Reasons, ", ") + ")")
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Where the agents listen for monitoring requests, unless morio.yaml says otherwise
+// FIXME: Make this platform agnostic
+const AgentSocketFolder string = "/var/run/morio"
+
+// Returns the http.host of an agent, as set in monitoring.<agent> in
+// morio.yaml, like localhost:5066, or a unix socket in AgentSocketFolder
+func AgentHTTPHost(agent string) string {
+	if host := viper.GetString("monitoring." + agent); host != "" {
+		return host
+	}
+
+	return defaultAgentHTTPHost(agent)
+}
+
+func defaultAgentHTTPHost(agent string) string {
+	return "unix://" + AgentSocketFolder + "/" + agent + ".sock"
+}
+
+// Makes sure the agents can create their socket
+func EnsureAgentSocketFolder() {
+	if err := os.MkdirAll(AgentSocketFolder, 0750); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Unable to create %s, the agent will not be monitored: %v\n", AgentSocketFolder, err)
+	}
+}
+
+// Returns the agent that a template belongs to, like logs for
+// logs/config.yaml.mustache, or an empty string
+// Absolute paths are taken relative to the root, like /etc/morio.
+func agentFromTemplate(path string, root string) string {
+	if relative, err := filepath.Rel(root, path); err == nil && filepath.IsAbs(path) {
+		path = filepath.ToSlash(relative)
+	}
+	agent, _, _ := strings.Cut(path, "/")
+	for _, known := range Agents {
+		if agent == known {
+			return agent
+		}
+	}
+
+	return ""
+}
+
+// Enables the monitoring endpoint in the configuration of an agent,
+// unless the template takes care of it
+func injectMonitoring(output string, path string, context map[string]string) string {
+	agent := context["MORIO_AGENT"]
+	if agent == "" {
+		return output
+	}
+	source, err := os.ReadFile(TemplatePath(path))
+	if err != nil || strings.Contains(string(source), "MORIO_AGENT_HTTP_HOST") {
+		return output
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal([]byte(output), &config); err != nil {
+		return output
+	}
+	for key := range config {
+		if key == "http" || strings.HasPrefix(key, "http.") {
+			fmt.Fprintf(os.Stderr, "Warning: Not enabling monitoring in %s, it already has http settings. Use the MORIO_AGENT_HTTP_HOST var in the template instead.\n", TemplatePath(path))
+			return output
+		}
+	}
+
+	block := "\n# Monitoring endpoint, used by 'morio status --deep'\n"
+	block += "http.enabled: true\n"
+	block += "http.host: " + context["MORIO_AGENT_HTTP_HOST"] + "\n"
+
+	return strings.TrimRight(output, "\n") + "\n" + block
+}
+
+// What the monitoring endpoint of an agent tells us
+type AgentHealth struct {
+	Agent   string        `json:"agent"`
+	Beat    string        `json:"beat"`
+	Version string        `json:"version"`
+	Uptime  time.Duration `json:"-"`
+	Output  string        `json:"output"`
+	// Pipeline counters, since the agent started
+	Published    int64   `json:"published"`
+	Acked        int64   `json:"acked"`
+	Failed       int64   `json:"failed"`
+	Dropped      int64   `json:"dropped"`
+	Active       int64   `json:"active"`
+	WriteErrors  int64   `json:"write_errors"`
+	ReadErrors   int64   `json:"read_errors"`
+	QueueEvents  int64   `json:"queue_events"`
+	QueueMax     int64   `json:"queue_max_events"`
+	QueueFilled  float64 `json:"queue_filled"`
+	Harvesters   int64   `json:"harvesters,omitempty"`
+	OpenFiles    int64   `json:"open_files,omitempty"`
+	HasHarvester bool    `json:"-"`
+}
+
+// Returns an HTTP client that talks to the monitoring endpoint of an agent,
+// and the base URL to use
+func agentHTTPClient(agent string) (*http.Client, string) {
+	host := AgentHTTPHost(agent)
+	client := &http.Client{Timeout: 5 * time.Second}
+	if socket, ok := strings.CutPrefix(host, "unix://"); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+		return client, "http://" + agent
+	}
+
+	return client, "http://" + host
+}
+
+// Fetches a JSON document from the monitoring endpoint of an agent
+func agentMonitoringGet(agent string, path string) (map[string]interface{}, error) {
+	client, base := agentHTTPClient(agent)
+	response, err := client.Get(base + path)
+	if err != nil {
+		// The URL is made up for unix sockets, so leave it out
+		var urlError *url.Error
+		if errors.As(err, &urlError) {
+			err = urlError.Err
+		}
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", path, response.Status)
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	return document, nil
+}
+
+// Asks an agent how it is doing, through its monitoring endpoint
+func GetAgentHealth(agent string) (AgentHealth, error) {
+	health := AgentHealth{Agent: agent, Beat: agentBeatName(agent)}
+	stats, err := agentMonitoringGet(agent, "/stats")
+	if err != nil {
+		return health, err
+	}
+	// The state is nice to have, older beats do not all have it
+	if state, err := agentMonitoringGet(agent, "/state"); err == nil {
+		health.Output, _ = jsonPath(state, "output.name").(string)
+		health.Version, _ = jsonPath(state, "beat.version").(string)
+	}
+
+	health.Uptime = time.Duration(jsonInt(stats, "beat.info.uptime.ms")) * time.Millisecond
+	health.Published = jsonInt(stats, "libbeat.pipeline.events.published")
+	health.Acked = jsonInt(stats, "libbeat.output.events.acked")
+	health.Failed = jsonInt(stats, "libbeat.output.events.failed") + jsonInt(stats, "libbeat.pipeline.events.failed")
+	health.Dropped = jsonInt(stats, "libbeat.output.events.dropped") + jsonInt(stats, "libbeat.pipeline.events.dropped")
+	health.Active = jsonInt(stats, "libbeat.pipeline.events.active")
+	health.WriteErrors = jsonInt(stats, "libbeat.output.write.errors")
+	health.ReadErrors = jsonInt(stats, "libbeat.output.read.errors")
+	health.QueueEvents = jsonInt(stats, "libbeat.pipeline.queue.filled.events")
+	health.QueueMax = jsonInt(stats, "libbeat.pipeline.queue.max_events")
+	if pct, ok := jsonPath(stats, "libbeat.pipeline.queue.filled.pct").(float64); ok {
+		health.QueueFilled = pct
+	} else if health.QueueMax > 0 {
+		health.QueueFilled = float64(health.QueueEvents) / float64(health.QueueMax)
+	}
+	if _, ok := jsonPath(stats, "filebeat.harvester").(map[string]interface{}); ok {
+		health.HasHarvester = true
+		health.Harvesters = jsonInt(stats, "filebeat.harvester.running")
+		health.OpenFiles = jsonInt(stats, "filebeat.harvester.open_files")
+	}
+
+	return health, nil
+}
+
+// Prints the health of an agent, below its status line
+func PrintAgentHealth(agent string) {
+	indent := fmt.Sprintf("  %-8s ", "")
+	health, err := GetAgentHealth(agent)
+	if err != nil {
+		fmt.Printf("%sunable to reach the monitoring endpoint at %s: %v\n", indent, AgentHTTPHost(agent), err)
+		return
+	}
+	fmt.Printf("%suptime      %s\n", indent, health.Uptime.Round(time.Second))
+	fmt.Printf("%sevents      %d published, %d acked, %d failed, %d dropped, %d active\n", indent, health.Published, health.Acked, health.Failed, health.Dropped, health.Active)
+	output := health.Output
+	if output == "" {
+		output = "unknown"
+	}
+	fmt.Printf("%soutput      %s, %d write errors, %d read errors\n", indent, output, health.WriteErrors, health.ReadErrors)
+	fmt.Printf("%squeue       %d of %d events (%.1f%%)\n", indent, health.QueueEvents, health.QueueMax, health.QueueFilled*100)
+	if health.HasHarvester {
+		fmt.Printf("%sharvesters  %d running, %d open files\n", indent, health.Harvesters, health.OpenFiles)
+	}
+}
+
+// Returns the value at a dotted path in a JSON document, or nil
+func jsonPath(document map[string]interface{}, path string) interface{} {
+	var value interface{} = document
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+
+	return value
+}
+
+func jsonInt(document map[string]interface{}, path string) int64 {
+	if number, ok := jsonPath(document, path).(float64); ok {
+		return int64(number)
+	}
+
+	return 0
+}
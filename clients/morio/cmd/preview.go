@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// morio preview
+var previewCmd = &cobra.Command{
+	Use:       "preview [audit|logs|metrics]",
+	Short:     "Preview the events an agent would ship",
+	ValidArgs: []string{"audit", "logs", "metrics"},
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	Long: `Runs an agent with the rendered configuration, but with its output
+replaced by the console, and prints the events it would ship.
+
+This allows to check parsing, fields and tags of a new input or module
+before any data reaches the collector. The agent stops after --events
+events or after --duration, whichever comes first.
+
+The preview uses its own data folder, so it does not touch the state
+(like the registry of files already read) of the agent that runs as a
+service. As a result, the logs agent will read files from the start.
+Use --output to also write the raw events to a file.`,
+	Example: `  morio preview logs
+  morio preview metrics --events 5
+  morio preview audit --duration 1m --output /tmp/audit-events.ndjson`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := PreviewAgent(args[0], previewEvents, previewDuration, previewOutput); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var previewEvents int
+var previewDuration time.Duration
+var previewOutput string
+
+func init() {
+	RootCmd.AddCommand(previewCmd)
+	previewCmd.Flags().IntVar(&previewEvents, "events", 10, "Stop after this many events")
+	previewCmd.Flags().DurationVar(&previewDuration, "duration", 30*time.Second, "Stop after this long")
+	previewCmd.Flags().StringVar(&previewOutput, "output", "", "Also write the raw events to this file")
+}
+
+// Runs an agent with the console as output, and prints the events
+func PreviewAgent(agent string, events int, duration time.Duration, output string) error {
+	folder, err := os.MkdirTemp("", "morio-preview-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(folder)
+
+	config, err := PreviewConfig(agent, folder)
+	if err != nil {
+		return err
+	}
+
+	var save io.Writer
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		save = file
+	}
+
+	path, err := VerifiedBeatPath(agent, false)
+	if err != nil {
+		return err
+	}
+	beat := exec.Command(path, "-c", config, "--strict.perms=false")
+	// Errors that stop the agent are written to stderr
+	beat.Stderr = os.Stderr
+	stdout, err := beat.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := beat.Start(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Previewing %s agent, stopping after %d events or %s\n\n", agent, events, duration)
+
+	// Read events until we have enough, or the agent exits
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	timeout := time.After(duration)
+	count := 0
+	exited := false
+	for !exited && count < events {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				exited = true
+				break
+			}
+			if !strings.HasPrefix(strings.TrimSpace(line), "{") {
+				continue
+			}
+			count++
+			if save != nil {
+				fmt.Fprintln(save, line)
+			}
+			fmt.Println(prettyEvent(line))
+		case <-timeout:
+			exited = true
+		}
+	}
+
+	// Stop the agent, and give it some time to shut down cleanly
+	beat.Process.Signal(syscall.SIGTERM)
+	done := make(chan error)
+	go func() {
+		for range lines {
+		}
+		done <- beat.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		beat.Process.Kill()
+		err = <-done
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%d events previewed\n", count)
+	if count == 0 && err != nil {
+		// The agent failed, so show why
+		if log, readErr := os.ReadFile(filepath.Join(folder, "agent.log")); readErr == nil {
+			fmt.Fprintln(os.Stderr, string(log))
+		}
+		return fmt.Errorf("%s exited: %v", agentBeatName(agent), err)
+	}
+
+	return nil
+}
+
+// Writes a copy of the rendered agent config, with the output replaced
+// by the console, and all state kept in the given folder.
+func PreviewConfig(agent string, folder string) (string, error) {
+	data, err := os.ReadFile(GetConfigPath(agent, "config.yaml"))
+	if err != nil {
+		return "", fmt.Errorf("unable to read the %s configuration, run 'morio template' first: %v", agent, err)
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "", fmt.Errorf("unable to parse the %s configuration: %v", agent, err)
+	}
+	if config == nil {
+		config = make(map[string]interface{})
+	}
+
+	// Beats only allow one output, so remove all of them
+	// Settings can be nested (output: kafka: ...) or dotted (output.kafka: ...)
+	for key := range config {
+		if key == "output" || strings.HasPrefix(key, "output.") || key == "http" || strings.HasPrefix(key, "http.") {
+			delete(config, key)
+		}
+	}
+	config["output.console"] = map[string]interface{}{"codec.json": map[string]interface{}{"pretty": false}}
+	// Keep ${path.config}/modules.d pointing to the real modules
+	config["path.config"] = GetConfigPath(agent)
+	config["path.data"] = filepath.Join(folder, "data")
+	config["path.logs"] = folder
+	config["logging.to_files"] = true
+	config["logging.files"] = map[string]interface{}{"path": folder, "name": "agent.log"}
+	config["http.enabled"] = false
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(folder, "config.yaml")
+
+	return path, os.WriteFile(path, out, 0600)
+}
+
+// Indents an event, or returns it as-is if it is not JSON
+func prettyEvent(line string) string {
+	var buffer bytes.Buffer
+	if err := json.Indent(&buffer, []byte(line), "", "  "); err != nil {
+		return line
+	}
+
+	return buffer.String()
+}
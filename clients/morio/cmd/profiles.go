@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// morio profile
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage module profiles",
+	Long: `Manages module profiles for host roles.
+
+A profile bundles the modules to enable or disable, and the vars to set,
+for a given type of host such as a web server or database host.
+Profiles are stored as YAML files in /etc/morio/profiles.d, for example:
+
+  # /etc/morio/profiles.d/webserver.yaml
+  about: Public-facing web servers
+  modules:
+    enable:
+      - linux-system
+      - nginx
+    disable:
+      - mysql
+  vars:
+    NGINX_LOG_PATH: /srv/logs/nginx`,
+}
+
+// morio profile list
+var profileListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List profiles",
+	Long:  `Lists the available profiles, and whether they are applied.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ShowProfileList()
+	},
+}
+
+// morio profile apply
+var profileApplyCmd = &cobra.Command{
+	Use:   "apply [profile-name]",
+	Short: "Apply a profile",
+	Long: `Applies a profile to this host.
+
+This enables and disables modules, and sets vars, as one operation.
+If any of the changes fails, the ones already made are rolled back.
+Run 'morio template' afterwards to update the agent configuration.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio profile apply webserver",
+	Run: func(cmd *cobra.Command, args []string) {
+		profile, err := LoadProfile(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		changes, err := ProfileChanges(profile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(changes) == 0 {
+			fmt.Println("Profile " + args[0] + " is already applied")
+			return
+		}
+		if remaining, err := ApplyProfileChanges(changes); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if len(remaining) == 0 {
+				fmt.Fprintln(os.Stderr, "No changes were made")
+			} else {
+				fmt.Fprintln(os.Stderr, "These changes could not be rolled back, and are still in place:")
+				for _, change := range remaining {
+					fmt.Fprintln(os.Stderr, " - "+change.String())
+				}
+			}
+			os.Exit(1)
+		}
+		ShowProfileChanges(changes)
+		fmt.Println("\nProfile " + args[0] + " applied. Run 'morio template' to update the configuration.")
+	},
+}
+
+// morio profile diff
+var profileDiffCmd = &cobra.Command{
+	Use:     "diff [profile-name]",
+	Short:   "Show what applying a profile would change",
+	Long:    `Shows the module and var changes that applying a profile would make.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio profile diff webserver",
+	Run: func(cmd *cobra.Command, args []string) {
+		profile, err := LoadProfile(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		changes, err := ProfileChanges(profile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(changes) == 0 {
+			fmt.Println("Profile " + args[0] + " is already applied")
+		} else {
+			ShowProfileChanges(changes)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(profileCmd)
+	profileCmd.AddCommand(profileListCmd)
+	profileCmd.AddCommand(profileApplyCmd)
+	profileCmd.AddCommand(profileDiffCmd)
+}
+
+// Location of the profiles
+const ProfileFolder string = "/etc/morio/profiles.d"
+
+type Profile struct {
+	Name    string                 `yaml:"-"`
+	About   string                 `yaml:"about"`
+	Modules ProfileModules         `yaml:"modules"`
+	Vars    map[string]interface{} `yaml:"vars"`
+}
+
+type ProfileModules struct {
+	Enable  []string `yaml:"enable"`
+	Disable []string `yaml:"disable"`
+}
+
+// Allow a plain list of modules as a shorthand for the modules to enable
+func (m *ProfileModules) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&m.Enable)
+	}
+	type plain ProfileModules
+	return value.Decode((*plain)(m))
+}
+
+// A single change made when applying a profile
+// For modules, From and To are the template file names before and after.
+// For vars, From and To are the custom values before and after, and
+// Previous holds the effective value (which may be a default) before.
+type ProfileChange struct {
+	Kind     string // module or var
+	Action   string // enable, disable, or set
+	Name     string
+	Folder   string
+	From     string
+	To       string
+	Previous string
+	WasSet   bool
+}
+
+func (change ProfileChange) String() string {
+	switch change.Action {
+	case "enable":
+		return "enable module " + change.Name + " (" + change.Folder + ")"
+	case "disable":
+		return "disable module " + change.Name + " (" + change.Folder + ")"
+	}
+	return "set var " + change.Name + ": " + change.Previous + " -> " + change.To
+}
+
+func ProfileList() []string {
+	var names []string
+	files, err := os.ReadDir(ProfileFolder)
+	if err != nil {
+		return names
+	}
+	for _, file := range files {
+		suffix := filepath.Ext(file.Name())
+		if !file.IsDir() && (suffix == ".yaml" || suffix == ".yml") {
+			names = append(names, strings.TrimSuffix(file.Name(), suffix))
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func LoadProfile(name string) (Profile, error) {
+	var profile Profile
+	// Only load profiles from the profile folder
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return profile, fmt.Errorf("invalid profile name %q", name)
+	}
+	path := filepath.Join(ProfileFolder, name+".yaml")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		path = filepath.Join(ProfileFolder, name+".yml")
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return profile, fmt.Errorf("unable to load profile %s: %v", name, err)
+	}
+	if err := yaml.Unmarshal(data, &profile); err != nil {
+		return profile, fmt.Errorf("unable to parse profile %s: %v", path, err)
+	}
+	profile.Name = name
+
+	return profile, nil
+}
+
+// Works out what needs to change to apply a profile, without changing anything
+func ProfileChanges(profile Profile) ([]ProfileChange, error) {
+	var changes []ProfileChange
+
+	known := make(map[string]bool)
+	for _, folder := range moduleFolders {
+		enabled, disabled := ModuleList(folder)
+		for _, file := range append(enabled, disabled...) {
+			known[ModuleNameFromFile(file)] = true
+		}
+	}
+	for _, module := range append(profile.Modules.Enable, profile.Modules.Disable...) {
+		if !known[module] {
+			return nil, fmt.Errorf("profile %s refers to unknown module %s", profile.Name, module)
+		}
+	}
+	for _, module := range profile.Modules.Enable {
+		if contains(profile.Modules.Disable, module) {
+			return nil, fmt.Errorf("profile %s both enables and disables module %s", profile.Name, module)
+		}
+	}
+
+	for _, folder := range moduleFolders {
+		enabled, disabled := ModuleList(folder)
+		for _, module := range profile.Modules.Enable {
+			for _, file := range disabled {
+				if ModuleNameFromFile(file) == module {
+					changes = append(changes, ProfileChange{
+						Kind:   "module",
+						Name:   module,
+						Folder: folder,
+						From:   file,
+						To:     module + ".yaml",
+						Action: "enable",
+					})
+				}
+			}
+		}
+		for _, module := range profile.Modules.Disable {
+			for _, file := range enabled {
+				if ModuleNameFromFile(file) == module {
+					changes = append(changes, ProfileChange{
+						Kind:   "module",
+						Name:   module,
+						Folder: folder,
+						From:   file,
+						To:     module + ".yaml.disabled",
+						Action: "disable",
+					})
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(profile.Vars))
+	for key := range profile.Vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Check up front, so we do not have to roll back because of it
+		if err := checkVarName(key); err != nil {
+			return nil, fmt.Errorf("profile %s sets var %s: %v", profile.Name, key, err)
+		}
+		if profile.Vars[key] == nil {
+			return nil, fmt.Errorf("profile %s sets var %s to null, give it a value or leave it out", profile.Name, key)
+		}
+		value := stringifyVarValue(profile.Vars[key])
+		previous := GetVar(key)
+		if previous == value {
+			continue
+		}
+		current, err := os.ReadFile(CustomVarFolder + "/" + key)
+		changes = append(changes, ProfileChange{
+			Kind:     "var",
+			Name:     key,
+			From:     string(current),
+			To:       value,
+			Previous: previous,
+			WasSet:   err == nil,
+			Action:   "set",
+		})
+	}
+
+	return changes, nil
+}
+
+// Applies all changes, or none of them
+// When a change fails, the changes already made are rolled back. The
+// changes that could not be rolled back are returned with the error.
+func ApplyProfileChanges(changes []ProfileChange) ([]ProfileChange, error) {
+	for i, change := range changes {
+		var err error
+		switch change.Kind {
+		case "module":
+			err = os.Rename(GetConfigPath(change.Folder, change.From), GetConfigPath(change.Folder, change.To))
+		case "var":
+			err = ChangeVar("profile", change.Name, change.To)
+		}
+		if err != nil {
+			return rollbackProfileChanges(changes[:i]), fmt.Errorf("failed to %s: %v", change, err)
+		}
+	}
+
+	return nil, nil
+}
+
+// Undoes changes, in reverse order, and returns the ones it could not undo
+func rollbackProfileChanges(changes []ProfileChange) []ProfileChange {
+	var remaining []ProfileChange
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		var err error
+		switch change.Kind {
+		case "module":
+			err = os.Rename(GetConfigPath(change.Folder, change.To), GetConfigPath(change.Folder, change.From))
+		case "var":
+			if change.WasSet {
+				err = ChangeVar("rollback", change.Name, change.From)
+			} else {
+				err = RemoveVar("rollback", change.Name)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to roll back '%s': %v\n", change, err)
+			remaining = append(remaining, change)
+		}
+	}
+
+	return remaining
+}
+
+func ShowProfileChanges(changes []ProfileChange) {
+	signs := map[string]string{"enable": "+", "disable": "-", "set": "~"}
+	for _, change := range changes {
+		fmt.Println(signs[change.Action] + " " + change.String())
+	}
+}
+
+func ShowProfileList() {
+	names := ProfileList()
+	if len(names) == 0 {
+		fmt.Println("No profiles found in " + ProfileFolder)
+		return
+	}
+	fmt.Println("Profiles:")
+	for _, name := range names {
+		profile, err := LoadProfile(name)
+		if err != nil {
+			fmt.Printf(" ! %-16s %v\n", name, err)
+			continue
+		}
+		status := "not applied"
+		if changes, err := ProfileChanges(profile); err != nil {
+			status = "invalid"
+		} else if len(changes) == 0 {
+			status = "applied"
+		}
+		fmt.Printf(" - %-16s %-12s %s\n", name, status, strings.TrimSpace(profile.About))
+	}
+}
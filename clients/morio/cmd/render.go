@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+// morio template render
+var templateRenderCmd = &cobra.Command{
+	Use:   "render [template-path]",
+	Short: "Render a single template to stdout",
+	Long: `Renders a single template, and prints the result.
+
+The template is rendered the same way as 'morio template' does, including
+the layout and run-time vars, but nothing is written to disk.
+Use --var to override the value of a var for this render only.
+Use --explain to show where the value of each var used comes from.`,
+	Args: cobra.ExactArgs(1),
+	Example: `  morio template render logs/module-templates.d/nginx.yaml
+  morio template render logs/module-templates.d/nginx.yaml --var NGINX_LOG_PATH=/srv/logs --explain`,
+	Run: func(cmd *cobra.Command, args []string) {
+		path := resolveTemplatePath(args[0])
+		if _, err := os.Stat(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		overrides, err := parseVarFlags(renderVars)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Template defaults first, then the vars on this host, then the overrides
+		tags, err := LoadTags()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		context := ExtractTemplateDefaultVars(path)
+		for key, value := range GetVars() {
+			context[key] = value
+		}
+		for key, value := range TagVars(tags) {
+			context[key] = value
+		}
+		// Overriding facts allows to see how the template renders on another host
+		facts := HostFacts()
+		for key, value := range overrides {
+			if isFact(key) {
+				facts[key] = value
+			} else {
+				context[key] = value
+			}
+		}
+		context = ContextWithFacts(context, facts)
+
+		output, err := RenderTemplate(path, path, GetConfigPath("template-layout.mustache"), context)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Failed to render %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		if renderExplain {
+			resolved, _, _ := ResolveVars(context, TemplateVarNames(path))
+			ExplainTemplateVars(path, resolved, overrides)
+		}
+		fmt.Print(output)
+	},
+}
+
+var renderVars []string
+var renderExplain bool
+
+func init() {
+	templateCmd.AddCommand(templateRenderCmd)
+	templateRenderCmd.Flags().StringArrayVar(&renderVars, "var", nil, "Set a var as KEY=VALUE for this render (can be repeated)")
+	templateRenderCmd.Flags().BoolVar(&renderExplain, "explain", false, "Show where the value of each var comes from (on stderr)")
+}
+
+// Parses vars passed as KEY=VALUE
+func parseVarFlags(flags []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("vars should be passed as KEY=VALUE, not %s", flag)
+		}
+		vars[key] = value
+	}
+
+	return vars, nil
+}
+
+// Prints the value and source of all vars used in a template to stderr
+func ExplainTemplateVars(path string, context map[string]string, overrides map[string]string) {
+	fmt.Fprintln(os.Stderr, "# Vars used in "+path)
+	for _, name := range runtimeVars {
+		fmt.Fprintf(os.Stderr, "#   %s = %q\n#     from: run-time\n", name, context[name])
+	}
+	for _, name := range TemplateVarNames(path) {
+		source := "command-line (--var)"
+		if _, ok := overrides[name]; !ok && isFact(name) {
+			source = "host fact"
+		} else if !ok && isTagVar(name) {
+			source = "host tags (" + TagsFile + ")"
+		} else if !ok {
+			source = VarSource(VarLayers(name, []string{path}))
+		}
+		fmt.Fprintf(os.Stderr, "#   %s = %q\n#     from: %s\n", name, context[name], source)
+	}
+	fmt.Fprintln(os.Stderr)
+}
@@ -67,27 +67,44 @@ var restartCmd = &cobra.Command{
 
 // morio status
 var statusCmd = &cobra.Command{
-	Use:   "status",
+	Use:   "status [audit|logs|metrics]",
 	Short: "Shows agents status",
-	Long:  "Shows the status of all agents, or the one you pass it",
+	Long: `Shows the status of all agents, or the one you pass it.
+
+Use --deep to also ask the agents how they are doing, through their
+monitoring endpoint: events published, acked, failed and dropped, output
+errors, queue fill, and harvesters for the logs agent.
+
+The endpoint is enabled in the rendered configuration of each agent, on
+a unix socket in ` + AgentSocketFolder + `, or on the address you set in
+monitoring.<agent> in morio.yaml, like localhost:5066. Templates that set
+http.* themselves can use the MORIO_AGENT_HTTP_HOST var.`,
+	ValidArgs: Agents,
+	Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
 	Example: `  Show the status of all agents:
     morio status
 
   Show the status of a specific agent:
-    morio status logs`,
+    morio status logs
+
+  Show the health of all agents:
+    morio status --deep`,
 	Run: func(cmd *cobra.Command, args []string) {
-		if args[0] == "audit" {
-			PrintAgentStatus("audit")
-		} else if args[0] == "metrics" {
-			PrintAgentStatus("metrics")
-		} else if args[0] == "logs" {
-			PrintAgentStatus("logs")
-		} else {
-			ShowStatus()
+		agents := Agents
+		if len(args) == 1 {
+			agents = args
+		}
+		for _, agent := range agents {
+			PrintAgentStatus(agent, true)
+			if statusDeep {
+				PrintAgentHealth(agent)
+			}
 		}
 	},
 }
 
+var statusDeep bool
+
 // morio start audit
 var startAuditCmd = &cobra.Command{
 	Use:     "audit",
@@ -201,6 +218,7 @@ func init() {
 	RootCmd.AddCommand(startCmd)
 	RootCmd.AddCommand(stopCmd)
 	RootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().BoolVar(&statusDeep, "deep", false, "Also show the health of the agents, from their monitoring endpoint")
 	restartCmd.AddCommand(restartAuditCmd)
 	restartCmd.AddCommand(restartMetricsCmd)
 	restartCmd.AddCommand(restartLogsCmd)
@@ -298,7 +316,10 @@ func IsAgentRunning(agent string) (bool, error) {
 	return false, nil
 }
 
-func PrintAgentStatus(agent string) {
+// Prints whether an agent is running
+// With checkBinary, it also checks the binary of the agent and its version,
+// which runs the binary, so we only do that when asked for the status.
+func PrintAgentStatus(agent string, checkBinary bool) {
 	emoji := "!"
 	status := "stopped"
 	running, err := IsAgentRunning(agent)
@@ -307,11 +328,22 @@ func PrintAgentStatus(agent string) {
 		emoji = " "
 		status = "running"
 	}
-	fmt.Printf("%s %s %s\n", emoji, fmt.Sprintf("%-8s", agent), fmt.Sprintf("%-14s", status))
+	if !checkBinary {
+		fmt.Printf("%s %s %s\n", emoji, fmt.Sprintf("%-8s", agent), fmt.Sprintf("%-14s", status))
+		return
+	}
+	binary := CheckBeat(agent)
+	if len(binary.Problems) > 0 {
+		emoji = "!"
+	}
+	fmt.Printf("%s %s %s %s\n", emoji, fmt.Sprintf("%-8s", agent), fmt.Sprintf("%-14s", status), binary.Summary())
+	for _, problem := range binary.Problems {
+		fmt.Printf("  %-8s %s\n", "", problem)
+	}
 }
 
 func ShowStatus() {
-	PrintAgentStatus("audit")
-	PrintAgentStatus("metrics")
-	PrintAgentStatus("logs")
+	PrintAgentStatus("audit", false)
+	PrintAgentStatus("metrics", false)
+	PrintAgentStatus("logs", false)
 }
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// morio tags
+var tagsCmd = &cobra.Command{
+	Use:   "tags",
+	Short: "Manage host tags",
+	Long: `Manages the tags of this host, like its environment, owner team,
+or criticality. Tags are key/value pairs that are added to all events
+shipped from this host, so dashboards can filter on them.
+
+Tags are stored in /etc/morio/tags.yaml. When you run 'morio template',
+they are added as 'fields' to the configuration of every agent, unless
+the agent configuration template places them itself with these vars:
+
+  MORIO_TAGS       A list of tags, with a key and value for each tag:
+                     fields:
+                     {{#MORIO_TAGS}}
+                       {{ key }}: "{{{ value }}}"
+                     {{/MORIO_TAGS}}
+  MORIO_TAGS_LIST  A list of the tags as key:value strings
+
+Run 'morio apply' after changing tags to update the agents.`,
+}
+
+// morio tags list
+var tagsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List host tags",
+	Long:  `Lists the tags of this host.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		tags, err := LoadTags()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(tags) == 0 {
+			fmt.Println("This host has no tags")
+			return
+		}
+		for _, key := range sortedKeys(tags) {
+			fmt.Printf("%-20s %s\n", key, tags[key])
+		}
+	},
+}
+
+// morio tags set
+var tagsSetCmd = &cobra.Command{
+	Use:   "set KEY value",
+	Short: "Set a host tag",
+	Long:  `Sets the value of a tag of this host.`,
+	Args:  cobra.ExactArgs(2),
+	Example: `  morio tags set environment production
+  morio tags set team soc`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := SetTag(args[0], args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// morio tags rm
+var tagsRmCmd = &cobra.Command{
+	Use:     "rm KEY",
+	Short:   "Remove a host tag",
+	Long:    `Removes a tag from this host.`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio tags rm team",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := RmTag(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(tagsCmd)
+	tagsCmd.AddCommand(tagsListCmd)
+	tagsCmd.AddCommand(tagsSetCmd)
+	tagsCmd.AddCommand(tagsRmCmd)
+}
+
+// Location of the host tags
+// FIXME: Make this platform agnostic
+const TagsFile string = "/etc/morio/tags.yaml"
+
+// Tag keys become field names, so keep them simple
+var validTagKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func LoadTags() (map[string]string, error) {
+	tags := make(map[string]string)
+	data, err := os.ReadFile(TagsFile)
+	if os.IsNotExist(err) {
+		return tags, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var parsed map[string]interface{}
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", TagsFile, err)
+	}
+	// The file can be edited by hand, so check what 'morio tags set' would
+	for key, value := range parsed {
+		if !validTagKey.MatchString(key) {
+			return nil, fmt.Errorf("invalid tag %q in %s, use only letters, digits, - and _", key, TagsFile)
+		}
+		tags[key] = stringifyVarValue(value)
+	}
+
+	return tags, nil
+}
+
+func SaveTags(tags map[string]string) error {
+	data, err := yaml.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(TagsFile, data, 0644)
+}
+
+func SetTag(key string, value string) error {
+	if !validTagKey.MatchString(key) {
+		return fmt.Errorf("invalid tag %q, use only letters, digits, - and _", key)
+	}
+	tags, err := LoadTags()
+	if err != nil {
+		return err
+	}
+	tags[key] = value
+
+	return SaveTags(tags)
+}
+
+func RmTag(key string) error {
+	tags, err := LoadTags()
+	if err != nil {
+		return err
+	}
+	if _, ok := tags[key]; !ok {
+		return fmt.Errorf("this host has no tag %s", key)
+	}
+	delete(tags, key)
+
+	return SaveTags(tags)
+}
+
+// Names of the vars that hold the host tags
+var tagVars = []string{"MORIO_TAGS", "MORIO_TAGS_LIST"}
+
+func isTagVar(key string) bool {
+	for _, name := range tagVars {
+		if key == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the vars that hold the host tags, for the template context
+func TagVars(tags map[string]string) map[string]string {
+	pairs := []map[string]string{}
+	list := []string{}
+	for _, key := range sortedKeys(tags) {
+		pairs = append(pairs, map[string]string{"key": key, "value": tags[key]})
+		list = append(list, key+":"+tags[key])
+	}
+
+	return map[string]string{
+		"MORIO_TAGS":      tagsJson(pairs),
+		"MORIO_TAGS_LIST": tagsJson(list),
+	}
+}
+
+// Like json.Marshal, but without escaping HTML characters like &
+func tagsJson(value interface{}) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+
+	return strings.TrimSpace(buffer.String())
+}
+
+// Adds the host tags as fields to a rendered agent configuration
+// Nothing is added if the template already uses the tag vars.
+func injectTags(output string, path string, context map[string]string) string {
+	var pairs []map[string]string
+	if err := json.Unmarshal([]byte(context["MORIO_TAGS"]), &pairs); err != nil || len(pairs) == 0 {
+		return output
+	}
+	source, err := os.ReadFile(TemplatePath(path))
+	if err != nil || strings.Contains(string(source), "MORIO_TAGS") {
+		return output
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal([]byte(output), &config); err != nil {
+		return output
+	}
+	if _, ok := config["fields"]; ok {
+		fmt.Fprintf(os.Stderr, "Warning: Not adding host tags to %s, it already has fields. Use the MORIO_TAGS var in the template instead.\n", TemplatePath(path))
+		return output
+	}
+
+	block := "\n# Host tags, managed with 'morio tags'\nfields:\n"
+	for _, pair := range pairs {
+		block += "  " + pair["key"] + ": " + strconv.Quote(pair["value"]) + "\n"
+	}
+
+	return strings.TrimRight(output, "\n") + "\n" + block
+}
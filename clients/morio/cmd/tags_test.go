@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderTagVars(t *testing.T) {
+	folder := t.TempDir()
+	path := filepath.Join(folder, "config.yaml.mustache")
+	layout := filepath.Join(folder, "template-layout.mustache")
+	// The blocks from the help of 'morio tags'
+	template := `fields:
+{{#MORIO_TAGS}}
+  {{ key }}: "{{{ value }}}"
+{{/MORIO_TAGS}}
+tags:
+{{#MORIO_TAGS_LIST}}
+  - "{{{ . }}}"
+{{/MORIO_TAGS_LIST}}
+`
+	if err := os.WriteFile(path, []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(layout, []byte("{{{ content }}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	context := TagVars(map[string]string{"environment": "production", "team": "r&d"})
+	output, err := RenderTemplate(path, path, layout, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `fields:
+  environment: "production"
+  team: "r&d"
+tags:
+  - "environment:production"
+  - "team:r&d"
+`
+	if output != want {
+		t.Errorf("RenderTemplate() =\n%s\nwant\n%s", output, want)
+	}
+}
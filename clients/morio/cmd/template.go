@@ -8,51 +8,265 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
-	// "strings"
+	"sort"
+	"strings"
+	"time"
 )
 
 // morio template
 var templateCmd = &cobra.Command{
-	Use:     "template",
-	Short:   "Template out the agents configuration",
-	Example: "  morio template",
-	Long:    `Templates out the configuration for the different agents.`,
+	Use:   "template",
+	Short: "Template out the agents configuration",
+	Example: `  morio template
+  morio template --all`,
+	Long: `Templates out the configuration for the different agents.
+
+Only files for which the template, or the vars it uses, changed since
+the last run are rendered again. Use --all to render everything.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		context := GetVars()
-		// Audit
-		TemplateOutFile("audit/config.yaml.mustache", "audit/config.yaml", context)
-		TemplateOutFolder("audit/module-templates.d", "audit/modules.d", context)
-		TemplateOutFolder("audit/rule-templates.d", "audit/rules.d", context)
-		// metrics
-		TemplateOutFile("metrics/config.yaml.mustache", "metrics/config.yaml", context)
-		TemplateOutFolder("metrics/module-templates.d", "metrics/modules.d", context)
-		// logs
-		TemplateOutFile("logs/config.yaml.mustache", "logs/config.yaml", context)
-		TemplateOutFolder("logs/module-templates.d", "logs/modules.d", context)
-		TemplateOutFolder("logs/input-templates.d", "logs/inputs.d", context)
-		// global vars
-		WriteGlobalVars()
+		changed, err := TemplateAll(templateForce)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(changed) == 0 {
+			fmt.Println("Configuration is up to date")
+		}
 	},
 }
 
+// morio apply
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Template out the configuration and restart affected agents",
+	Long: `Templates out the configuration for the different agents, and
+restarts only those agents for which the rendered configuration changed.`,
+	Example: "  morio apply",
+	Run: func(cmd *cobra.Command, args []string) {
+		result, err := ApplyConfiguration(templateForce)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(result.Restarted) == 0 && len(result.Errors) == 0 {
+			fmt.Println("Configuration is up to date, no agents to restart")
+		}
+		for _, agent := range result.Restarted {
+			fmt.Println("Restarted " + agent + " agent")
+		}
+		for _, message := range result.Errors {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", message)
+		}
+		fmt.Println()
+		ShowStatus()
+	},
+}
+
+var templateForce bool
+
 func init() {
 	RootCmd.AddCommand(templateCmd)
+	RootCmd.AddCommand(applyCmd)
+	templateCmd.Flags().BoolVar(&templateForce, "all", false, "Render all files, not only the ones that changed")
+	applyCmd.Flags().BoolVar(&templateForce, "all", false, "Render all files, and restart all agents with changes")
+}
+
+// A template file or folder, and where it is rendered to
+type TemplateTarget struct {
+	Agent  string
+	From   string
+	To     string
+	Folder bool
+}
+
+// Everything that 'morio template' renders
+var TemplateTargets = []TemplateTarget{
+	// Audit
+	{"audit", "audit/config.yaml.mustache", "audit/config.yaml", false},
+	{"audit", "audit/module-templates.d", "audit/modules.d", true},
+	{"audit", "audit/rule-templates.d", "audit/rules.d", true},
+	// metrics
+	{"metrics", "metrics/config.yaml.mustache", "metrics/config.yaml", false},
+	{"metrics", "metrics/module-templates.d", "metrics/modules.d", true},
+	// logs
+	{"logs", "logs/config.yaml.mustache", "logs/config.yaml", false},
+	{"logs", "logs/module-templates.d", "logs/modules.d", true},
+	{"logs", "logs/input-templates.d", "logs/inputs.d", true},
+}
+
+// Renders all templates that changed and records the result in the manifest
+// Returns the output files whose content changed, or that were removed
+func TemplateAll(force bool) ([]ManifestEntry, error) {
+	return renderTemplates(force, false)
+}
+
+// Like TemplateAll, but only renders the files that are out of date
+// Files that were modified by hand, and orphaned files, are left alone.
+func TemplateOutOfDate() ([]ManifestEntry, error) {
+	return renderTemplates(false, true)
+}
+
+func renderTemplates(force bool, onlyOutOfDate bool) ([]ManifestEntry, error) {
+	// Write the default vars first, so they are available when rendering
+	for _, target := range TemplateTargets {
+		for _, from := range target.Sources() {
+			for key, value := range ExtractTemplateDefaultVars(from) {
+				SetDefaultVar(key, value)
+			}
+		}
+	}
+	WriteGlobalVars()
+
+	context, err := GetContext()
+	if err != nil {
+		return nil, err
+	}
+	previous := LoadManifest()
+	manifest := TemplateManifest{Files: map[string]ManifestEntry{}}
+	var changed []ManifestEntry
+	for _, target := range TemplateTargets {
+		expected := make(map[string]bool)
+		for _, from := range target.Sources() {
+			to := target.Output(from)
+			expected[to] = true
+			entry, ok := previous.Files[to]
+			if ok && !force {
+				if state, _ := FileDrift(entry, context); state == "" || (state == "hand-modified" && onlyOutOfDate) {
+					manifest.Files[to] = entry
+					continue
+				}
+			}
+			before := hashFile(GetConfigPath(to))
+			entry = TemplateOutFile(from, to, context)
+			entry.Agent = target.Agent
+			manifest.Files[to] = entry
+			if entry.OutputHash != before {
+				changed = append(changed, entry)
+			}
+		}
+		if target.Folder && !onlyOutOfDate {
+			for _, to := range ClearFolder(target.To, expected) {
+				changed = append(changed, ManifestEntry{Output: to, Agent: target.Agent})
+			}
+		}
+	}
+	// Rendering errors do not return, so every template was rendered
+	manifest.LastRun = time.Now().UTC()
+	SaveManifest(manifest)
+
+	return changed, nil
+}
+
+// What 'morio apply' did
+type ApplyResult struct {
+	Changed   []string `json:"changed"`
+	Restarted []string `json:"restarted"`
+	Errors    []string `json:"errors"`
+}
+
+// Templates out the configuration, and restarts the agents whose configuration changed
+func ApplyConfiguration(force bool) (ApplyResult, error) {
+	changed, err := TemplateAll(force)
+	if err != nil {
+		return ApplyResult{}, err
+	}
+
+	return RestartChangedAgents(changed), nil
+}
+
+// Restarts the agents that own any of the changed files
+func RestartChangedAgents(changed []ManifestEntry) ApplyResult {
+	result := ApplyResult{Restarted: []string{}, Errors: []string{}}
+	result.Changed = manifestOutputs(changed)
+	for _, agent := range ChangedAgents(changed) {
+		if err := ChangeAgentState(agent, "restart"); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to restart %s agent: %v", agent, err))
+			continue
+		}
+		result.Restarted = append(result.Restarted, agent)
+	}
+
+	return result
+}
+
+func manifestOutputs(entries []ManifestEntry) []string {
+	outputs := []string{}
+	for _, entry := range entries {
+		outputs = append(outputs, entry.Output)
+	}
+
+	return outputs
+}
+
+// Returns the agents that own any of the files in the list
+func ChangedAgents(entries []ManifestEntry) []string {
+	var agents []string
+	for _, entry := range entries {
+		agents = joinUnique(agents, []string{entry.Agent})
+	}
+	sort.Strings(agents)
+
+	return agents
+}
+
+// Returns all template files on this host, including disabled ones
+func AllTemplateFiles() []string {
+	var files []string
+	for _, target := range TemplateTargets {
+		if !target.Folder {
+			if _, err := os.Stat(GetConfigPath(target.From)); err == nil {
+				files = append(files, target.From)
+			}
+			continue
+		}
+		entries, err := os.ReadDir(GetConfigPath(target.From))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			suffix := filepath.Ext(entry.Name())
+			if !entry.IsDir() && (suffix == ".yaml" || suffix == ".disabled") {
+				files = append(files, target.From+"/"+entry.Name())
+			}
+		}
+	}
+
+	return files
+}
+
+// Returns the output file for a template file of this target
+func (target TemplateTarget) Output(from string) string {
+	if target.Folder {
+		return target.To + "/" + filepath.Base(from)
+	}
+
+	return target.To
 }
 
-func TemplateOutFile(from string, to string, context map[string]string) {
+// Returns the template files of a target, relative to the config folder
+func (target TemplateTarget) Sources() []string {
+	if !target.Folder {
+		return []string{target.From}
+	}
+	var sources []string
+	for _, file := range TemplateList(target.From) {
+		sources = append(sources, target.From+"/"+file)
+	}
+
+	return sources
+}
+
+// Names of the vars that are injected at run-time for each template
+var runtimeVars = []string{"MORIO_TEMPLATE_SOURCE_FILE", "MORIO_MODULE_NAME", "MORIO_AGENT", "MORIO_AGENT_HTTP_HOST"}
+
+func TemplateOutFile(from string, to string, context map[string]string) ManifestEntry {
 	// Open file
 	file, err := os.Create(GetConfigPath(to))
 	check(err)
 	defer file.Close()
 
-	// Inject run-time vars
-	context["MORIO_TEMPLATE_SOURCE_FILE"] = GetConfigPath(from)
-	context["MORIO_MODULE_NAME"] = ModuleNameFromFile(from)
-
-
 	// Write value
-	output, err := mustache.RenderFileInLayout(GetConfigPath(from), GetConfigPath("template-layout.mustache"), context)
+	output, err := RenderTemplate(from, GetConfigPath(from), GetConfigPath("template-layout.mustache"), context)
 	if err != nil {
 		fmt.Println("Failed to render " + GetConfigPath(from))
 		panic(err)
@@ -69,21 +283,69 @@ func TemplateOutFile(from string, to string, context map[string]string) {
 	// Sync
 	file.Sync()
 
-	// Also extract the default vars and write them to disk
-	defaults := ExtractTemplateDefaultVars(from)
-	for key, value := range defaults {
-		SetDefaultVar(key, value)
+	vars := TemplateVarNames(from)
+	return ManifestEntry{
+		Output:     to,
+		Source:     from,
+		Vars:       vars,
+		SourceHash: hashFile(GetConfigPath(from)),
+		LayoutHash: hashFile(GetConfigPath("template-layout.mustache")),
+		VarsHash:   hashVars(context, vars),
+		HostHash:   hashAgentHost(from),
+		OutputHash: hashString(output),
+		Rendered:   time.Now().UTC(),
+	}
+}
+
+// Injects the run-time vars and renders a template in the layout
+// The source is what MORIO_TEMPLATE_SOURCE_FILE will be set to.
+func RenderTemplate(path string, source string, layout string, context map[string]string) (string, error) {
+	setRuntimeVars(context, path, source, filepath.Dir(layout))
+	context["MORIO_AGENT_HTTP_HOST"] = ""
+	if context["MORIO_AGENT"] != "" {
+		context["MORIO_AGENT_HTTP_HOST"] = AgentHTTPHost(context["MORIO_AGENT"])
+	}
+
+	return renderTemplateInLayout(path, layout, context)
+}
+
+// Sets the run-time vars that follow from the template itself
+// The root is the folder that holds the layout, like /etc/morio.
+func setRuntimeVars(context map[string]string, path string, source string, root string) {
+	context["MORIO_TEMPLATE_SOURCE_FILE"] = source
+	context["MORIO_MODULE_NAME"] = ModuleNameFromFile(path)
+	context["MORIO_AGENT"] = agentFromTemplate(path, root)
+}
+
+// Renders a template in the layout, once the run-time vars are set
+// Everything else the template needs comes from the folder of the layout.
+func renderTemplateInLayout(path string, layout string, context map[string]string) (string, error) {
+	context, warnings, err := ResolveVars(context, templateVarNames(path, layout))
+	if err != nil {
+		return "", err
 	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s in %s\n", warning, TemplatePath(path))
+	}
+
+	output, err := mustache.RenderFileInLayout(TemplatePath(path), layout, templateContext(path, filepath.Dir(layout), context))
+
+	return injectAgentTags(output, path, context), err
 }
 
-func TemplateOutFolder(from string, to string, context map[string]string) {
-	ClearFolder(to)
-	for _, file := range TemplateList(from) {
-		TemplateOutFile(from+"/"+file, to+"/"+file, context)
+// Host tags and monitoring are only added to the agent configuration, not to modules
+func injectAgentTags(output string, path string, context map[string]string) string {
+	if !strings.HasSuffix(path, ".mustache") || output == "" {
+		return output
 	}
+
+	return injectMonitoring(injectTags(output, path, context), path, context)
 }
 
-func ClearFolder(folder string) {
+// Removes rendered files from a folder, except for the ones to keep
+// Returns the files that were removed
+func ClearFolder(folder string, keep map[string]bool) []string {
+	var removed []string
 	path := GetConfigPath(folder)
 	files, err := os.ReadDir(path)
 	if err != nil {
@@ -94,13 +356,20 @@ func ClearFolder(folder string) {
 	for _, file := range files {
 		filePath := filepath.Join(path, file.Name())
 		suffix := filepath.Ext(file.Name())
+		if keep[folder+"/"+file.Name()] {
+			continue
+		}
 		if !file.IsDir() && (suffix == ".yaml" || suffix == ".disabled" || suffix == ".rules") {
 			if err := os.Remove(filePath); err != nil {
 				fmt.Println("Failed to remove file " + filePath)
 				fmt.Print(err)
+			} else {
+				removed = append(removed, folder+"/"+file.Name())
 			}
 		}
 	}
+
+	return removed
 }
 
 func TemplateList(folder string) []string {
@@ -122,6 +391,45 @@ func TemplateList(folder string) []string {
 	return files
 }
 
+// Returns the names of all vars used in a template, or in the layout
+func TemplateVarNames(path string) []string {
+	return templateVarNames(path, GetConfigPath("template-layout.mustache"))
+}
+
+func templateVarNames(path string, layoutPath string) []string {
+	var names []string
+	template, err := mustache.ParseFile(TemplatePath(path))
+	if err != nil {
+		return names
+	}
+	// In the layout, content is the rendered template
+	inLayout := false
+	var walk func(tags []mustache.Tag)
+	walk = func(tags []mustache.Tag) {
+		for _, tag := range tags {
+			if tag.Type() != mustache.Partial && tag.Name() != "MORIO_DOCS" && !isRuntimeVar(tag.Name()) && !(inLayout && tag.Name() == "content") {
+				names = joinUnique(names, []string{tag.Name()})
+			}
+			if tag.Type() == mustache.Section || tag.Type() == mustache.InvertedSection {
+				walk(tag.Tags())
+			}
+		}
+	}
+	walk(template.Tags())
+	// The layout is rendered with the same vars
+	if layout, err := mustache.ParseFile(layoutPath); err == nil {
+		inLayout = true
+		walk(layout.Tags())
+	}
+	// The host tags are added to all agent configurations
+	if strings.HasSuffix(path, ".mustache") {
+		names = joinUnique(names, tagVars)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
 func ExtractTemplateDefaultVars(from string) map[string]string {
 	docs := TemplateDocsAsYaml(from)
 
@@ -138,18 +446,7 @@ func ExtractTemplateDefaultVars(from string) map[string]string {
 	// Convert all values to strings in "defaults"
 	convertedData := make(map[string]string)
 	for key, value := range defaults {
-		switch v := value.(type) {
-		case string:
-			convertedData[key] = v
-		case bool:
-			convertedData[key] = strconv.FormatBool(v)
-		case int:
-			convertedData[key] = strconv.Itoa(v)
-		case float64:
-			convertedData[key] = strconv.FormatFloat(v, 'f', -1, 64)
-		default:
-			convertedData[key] = fmt.Sprintf("%v", v)
-		}
+		convertedData[key] = stringifyVarValue(value)
 	}
 
 	return convertedData
@@ -161,19 +458,52 @@ func isString(val interface{}) bool {
 }
 
 func TemplateDocsAsYaml(path string) map[string]interface{} {
+	result, err := ParseTemplateDocs(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Unable to parse MORIO_DOCS in %s: %v\n", TemplatePath(path), err)
+	}
+
+	return result
+}
+
+func ParseTemplateDocs(path string) (map[string]interface{}, error) {
 	// First render the template with MORIO_DOCS as true
-	context := map[string]bool{"MORIO_DOCS": true}
-	template, err := mustache.RenderFile(GetConfigPath(path), context)
+	template, err := RenderTemplateDocs(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// Now parse the result as YAML
 	var result map[string]interface{}
 	// Parse the YAML string
-	yaml.Unmarshal([]byte(template), &result)
+	err = yaml.Unmarshal([]byte(template), &result)
 
-	return result
+	return result, err
+}
+
+// Renders the template with MORIO_DOCS as true, which leaves only the docs
+func RenderTemplateDocs(path string) (string, error) {
+	context := map[string]bool{"MORIO_DOCS": true}
+
+	return mustache.RenderFile(TemplatePath(path), context)
+}
+
+// Returns the defaults in a global-vars.yaml file, if there is one
+func globalVarDefaults(file string) map[string]string {
+	defaults := make(map[string]string)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return defaults
+	}
+	var globals map[string]interface{}
+	yaml.Unmarshal(data, &globals)
+	for key, nested := range globals {
+		if entry, ok := nested.(map[string]interface{}); ok {
+			defaults[key] = stringifyVarValue(entry["default"])
+		}
+	}
+
+	return defaults
 }
 
 // FIXME: Make this platform agnostic
@@ -196,19 +526,7 @@ func WriteGlobalVars() {
 	for key, nested := range globals {
 		entry, ok := nested.(map[string]interface{})
 		if ok {
-			val, _ := entry["default"]
-			switch v := val.(type) {
-			case string:
-				SetDefaultVar(key, v)
-			case bool:
-				SetDefaultVar(key, strconv.FormatBool(v))
-			case int:
-				SetDefaultVar(key, strconv.Itoa(v))
-			case float64:
-				SetDefaultVar(key, strconv.FormatFloat(v, 'f', -1, 64))
-			default:
-				SetDefaultVar(key, fmt.Sprintf("%v", v))
-			}
+			SetDefaultVar(key, stringifyVarValue(entry["default"]))
 		}
 	}
 }
@@ -217,3 +535,14 @@ func WriteGlobalVars() {
 func GetConfigPath(parts ...string) string {
 	return filepath.Join(append([]string{"/etc", "morio"}, parts...)...)
 }
+
+// Returns the path to a template, relative to the config folder
+// Templates outside of it, like those that tests or lint are run on,
+// are passed as absolute paths, which are returned as-is.
+func TemplatePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return GetConfigPath(path)
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+)
+
+// Prompts for a secret, without echoing it to the terminal
+func readSecret(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	fd := int(os.Stdin.Fd())
+	if state, err := unix.IoctlGetTermios(fd, unix.TCGETS); err == nil {
+		silent := *state
+		silent.Lflag &^= unix.ECHO
+		if unix.IoctlSetTermios(fd, unix.TCSETS, &silent) == nil {
+			defer func() {
+				unix.IoctlSetTermios(fd, unix.TCSETS, state)
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	value, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	return strings.TrimRight(value, "\r\n")
+}
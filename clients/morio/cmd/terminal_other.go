@@ -0,0 +1,19 @@
+//go:build !linux
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prompts for a secret
+// FIXME: Do not echo the secret on this platform
+func readSecret(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	value, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	return strings.TrimRight(value, "\r\n")
+}
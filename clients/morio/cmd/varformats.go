@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Returns the format to use for a vars file, based on its extension
+func VarsFormatFromFile(path string) string {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".env":
+		return "env"
+	}
+
+	return "json"
+}
+
+// Keeps the vars whose name starts with the prefix
+func FilterVars(vars map[string]string, prefix string) map[string]string {
+	filtered := make(map[string]string)
+	for key, value := range vars {
+		if strings.HasPrefix(key, prefix) {
+			filtered[key] = value
+		}
+	}
+
+	return filtered
+}
+
+func EncodeVars(vars map[string]string, format string) (string, error) {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(vars, "", "  ")
+		return string(data), err
+	case "yaml":
+		data, err := yaml.Marshal(vars)
+		return string(data), err
+	case "env":
+		var builder strings.Builder
+		for _, key := range sortedKeys(vars) {
+			builder.WriteString(key + "=" + quoteEnvValue(vars[key]) + "\n")
+		}
+		return builder.String(), nil
+	}
+
+	return "", fmt.Errorf("unsupported format %s (should be json, yaml, or env)", format)
+}
+
+func DecodeVars(data []byte, format string) (map[string]string, error) {
+	vars, err := decodeVars(data, format)
+	if err != nil {
+		return nil, err
+	}
+	for key := range vars {
+		if err := checkVarName(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return vars, nil
+}
+
+// Var names are file names, so keep them inside the vars folder
+func checkVarName(key string) error {
+	if key == "" || strings.HasPrefix(key, ".") || strings.ContainsAny(key, "/\\") {
+		return fmt.Errorf("invalid var name %q", key)
+	}
+	if isFact(key) {
+		return fmt.Errorf("%s is a fact, which is read-only", key)
+	}
+
+	return nil
+}
+
+func decodeVars(data []byte, format string) (map[string]string, error) {
+	vars := make(map[string]string)
+	switch format {
+	case "json", "yaml":
+		var parsed map[string]interface{}
+		var err error
+		if format == "json" {
+			err = json.Unmarshal(data, &parsed)
+		} else {
+			err = yaml.Unmarshal(data, &parsed)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range parsed {
+			if value == nil {
+				vars[key] = ""
+			} else {
+				vars[key] = stringifyVarValue(value)
+			}
+		}
+		return vars, nil
+	case "env":
+		return decodeEnvVars(data)
+	}
+
+	return nil, fmt.Errorf("unsupported format %s (should be json, yaml, or env)", format)
+}
+
+var safeEnvValue = regexp.MustCompile(`^[A-Za-z0-9_./:,@%+=-]*$`)
+
+// Quotes a value for a dotenv file, if needed
+func quoteEnvValue(value string) string {
+	if safeEnvValue.MatchString(value) {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "$", `\$`)
+
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// Parses KEY=value lines, as written by quoteEnvValue
+// Comments, empty lines and a leading 'export' are ignored.
+func decodeEnvVars(data []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=value", number)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := unquoteEnvValue(value[1 : len(value)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", number, err)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+
+	return vars, scanner.Err()
+}
+
+func unquoteEnvValue(value string) (string, error) {
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			builder.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			return "", fmt.Errorf("value ends in an escape character")
+		}
+		switch value[i] {
+		case 'n':
+			builder.WriteByte('\n')
+		case 't':
+			builder.WriteByte('\t')
+		default:
+			builder.WriteByte(value[i])
+		}
+	}
+
+	return builder.String(), nil
+}
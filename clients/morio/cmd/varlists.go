@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Parses the value of a var that holds a list or a map
+// Such values are stored as JSON or YAML in the var file. All other
+// values are returned as-is, as a string.
+func ParseVarValue(value string) interface{} {
+	trimmed := strings.TrimSpace(value)
+	if !strings.HasPrefix(trimmed, "[") && !strings.HasPrefix(trimmed, "{") &&
+		!strings.HasPrefix(trimmed, "- ") && !strings.HasPrefix(trimmed, "---") {
+		return value
+	}
+	var parsed interface{}
+	if err := yaml.Unmarshal([]byte(trimmed), &parsed); err != nil {
+		return value
+	}
+	switch parsed.(type) {
+	case []interface{}, map[string]interface{}:
+		return parsed
+	}
+
+	return value
+}
+
+// Turns the (string) vars into the context for mustache
+// Only vars declared as a list or a map are parsed, so templates can use
+// them in sections. All other vars are passed as-is, so that values which
+// merely look like JSON still render unchanged.
+func templateContext(path string, root string, context map[string]string) map[string]interface{} {
+	structured := structuredVarNames(path, root)
+	result := make(map[string]interface{}, len(context))
+	for key, value := range context {
+		if structured[key] {
+			result[key] = ParseVarValue(value)
+		} else {
+			result[key] = value
+		}
+	}
+
+	return result
+}
+
+// Returns the vars that are declared as a list or a map, in global-vars.yaml
+// or in the MORIO_DOCS of the template, with their type or their default
+// The host tag vars are always lists. The root is the folder that holds
+// global-vars.yaml, like /etc/morio.
+func structuredVarNames(path string, root string) map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range tagVars {
+		names[name] = true
+	}
+	add := func(name string, entry interface{}) {
+		declaration, _ := entry.(map[string]interface{})
+		if isStructuredVar(declaration["type"], declaration["default"]) {
+			names[name] = true
+		}
+	}
+	var globals map[string]interface{}
+	if data, err := os.ReadFile(filepath.Join(root, "global-vars.yaml")); err == nil {
+		yaml.Unmarshal(data, &globals)
+	}
+	for name, entry := range globals {
+		add(name, entry)
+	}
+	// Errors in MORIO_DOCS are reported when the template is rendered
+	docs, _ := ParseTemplateDocs(path)
+	vars, _ := docs["vars"].(map[string]interface{})
+	local, _ := vars["local"].(map[string]interface{})
+	for name, entry := range local {
+		add(name, entry)
+	}
+	defaults, _ := vars["defaults"].(map[string]interface{})
+	for name, value := range defaults {
+		if isStructuredVar(nil, value) {
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+func isStructuredVar(kind interface{}, value interface{}) bool {
+	switch value.(type) {
+	case []interface{}, map[string]interface{}:
+		return true
+	}
+
+	return kind == "list" || kind == "map"
+}
+
+// Returns the items of a list var
+// An unset or empty var is an empty list.
+func varListItems(key string) ([]interface{}, error) {
+	value := GetVar(key)
+	if strings.TrimSpace(value) == "" {
+		return []interface{}{}, nil
+	}
+	list, ok := ParseVarValue(value).([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("var %s does not hold a list", key)
+	}
+
+	return list, nil
+}
+
+// Adds an item to a list var, unless it is already in the list
+func AddVarItem(key string, item string) error {
+	list, err := varListItems(key)
+	if err != nil {
+		return err
+	}
+	for _, existing := range list {
+		if stringifyVarValue(existing) == item {
+			return fmt.Errorf("%s is already in var %s", item, key)
+		}
+	}
+	data, err := json.Marshal(append(list, item))
+	if err != nil {
+		return err
+	}
+	return ChangeVar("add", key, string(data))
+}
+
+// Removes an item from a list var
+func RemoveVarItem(key string, item string) error {
+	list, err := varListItems(key)
+	if err != nil {
+		return err
+	}
+	kept := []interface{}{}
+	for _, existing := range list {
+		if stringifyVarValue(existing) != item {
+			kept = append(kept, existing)
+		}
+	}
+	if len(kept) == len(list) {
+		return fmt.Errorf("%s is not in var %s", item, key)
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return ChangeVar("remove", key, string(data))
+}
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/spf13/cobra"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -22,10 +25,46 @@ configuration and modules to manage. Morio ships these as templates
 that take various variables (vars). This command allows you to manage
 these vars.
 
+Var values can reference other vars, or facts about this host, with
+the ${NAME} syntax. For example:
+
+  morio vars set MORIO_BROKER_URL 'https://${MORIO_BROKER_HOST}:9092'
+
+References are resolved when the templates that use the var are rendered.
+Run 'morio facts' to see the available facts. References to names that are
+not a var or a fact are left as they are, with a warning, as the beats use
+the same syntax for environment variables and their keystore. Use $${NAME}
+to write a literal ${NAME} without the warning.
+
+Vars can also hold a list or a map, stored as JSON or YAML. Vars that
+are declared with 'type: list' or 'type: map', or with a list or map as
+their default, can be iterated over in templates with mustache sections,
+like {{#NAME}}...{{/NAME}}. All other vars render as they are stored.
+Use 'morio vars add' and 'morio vars remove' to edit lists:
+
+  morio vars add NGINX_LOG_PATHS /srv/logs/nginx
+
 To combine the configuration templates and your vars into an actual
 configuration, run 'morio template'.`,
 }
 
+// morio vars add
+var addCmd = &cobra.Command{
+	Use:   "add NAME item",
+	Short: "Add an item to a list var",
+	Long: `Adds an item to a template variable (var) that holds a list.
+If the var is not set, it becomes a list with this item.
+This will always write a custom template variable.`,
+	Args:    cobra.ExactArgs(2),
+	Example: "  morio vars add NGINX_LOG_PATHS /srv/logs/nginx",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := AddVarItem(args[0], args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
 // morio vars clear
 var clearCmd = &cobra.Command{
 	Use:   "clear NAME",
@@ -34,7 +73,10 @@ var clearCmd = &cobra.Command{
 This will always write a custom template variable.`,
 	Example: "  morio vars clear WARP_DRIVE",
 	Run: func(cmd *cobra.Command, args []string) {
-		SetVar(args[0], "false")
+		if err := ChangeVar("clear", args[0], ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -46,7 +88,10 @@ var disableCmd = &cobra.Command{
 This will always write a custom template variable.`,
 	Example: "  morio vars disable WARP_DRIVE",
 	Run: func(cmd *cobra.Command, args []string) {
-		SetVar(args[0], "false")
+		if err := ChangeVar("disable", args[0], "false"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -58,23 +103,56 @@ var enableCmd = &cobra.Command{
 This will always write a custom template variable.`,
 	Example: "  morio vars enable WARP_DRIVE",
 	Run: func(cmd *cobra.Command, args []string) {
-		SetVar(args[0], "true")
+		if err := ChangeVar("enable", args[0], "true"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// morio vars explain
+var explainCmd = &cobra.Command{
+	Use:   "explain NAME",
+	Short: "Explain where the value of a var comes from",
+	Long: `Shows the effective value of a template variable (var), the layer
+it comes from, any values it shadows, its description, and all templates
+and modules that use it.
+
+Values can come from these layers, from highest to lowest precedence:
+  - custom: set with 'morio vars set' in /etc/morio/vars.d
+  - default: written by 'morio template' in /etc/morio/default.vars.d
+  - template: the defaults in the MORIO_DOCS block of a template
+  - global: the defaults in /etc/morio/global-vars.yaml`,
+	Args:    cobra.ExactArgs(1),
+	Example: "  morio vars explain MORIO_TICK",
+	Run: func(cmd *cobra.Command, args []string) {
+		ExplainVar(args[0])
 	},
 }
 
 // morio vars export
 var exportCmd = &cobra.Command{
 	Use:   "export",
-	Short: "Exports vars to JSON",
-	Long: `Exports all template variables and their values",
-This will always write a custom template variable.`,
-	Example: "  morio vars export",
+	Short: "Exports vars to JSON, YAML, or dotenv",
+	Long: `Exports all template variables and their values.
+
+By default, this exports the effective value of all vars, including
+defaults. Use --only-custom to only export the vars you have set.
+Use --prefix to only export vars whose name starts with a prefix.`,
+	Example: `  morio vars export
+  morio vars export --format yaml --only-custom
+  morio vars export --format env --prefix MORIO_`,
 	Run: func(cmd *cobra.Command, args []string) {
-		allVarsAsJson, err := json.MarshalIndent(GetVars(), "", "  ")
+		vars := GetVars()
+		if exportOnlyCustom {
+			vars = GetCustomVars()
+		}
+		output, err := EncodeVars(FilterVars(vars, varsPrefix), varsFormat)
 		if err != nil {
-			fmt.Println("export failed JSON")
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
-		fmt.Print(string(allVarsAsJson))
+		fmt.Print(output)
 	},
 }
 
@@ -94,29 +172,77 @@ A custom NAME var has precedence over a default NAME var.`,
 
 // morio vars import
 var importCmd = &cobra.Command{
-	Args:    cobra.ExactArgs(1),
-	Example: "  morio vars import ~/morio_vars.json",
-	Use:     "import [file_path]",
-	Short:   "Import vars from a JSON file",
-	Long: `Imports vars from a JSON file.
-Run 'morio vars export' to see the JSON structure`,
+	Args: cobra.ExactArgs(1),
+	Example: `  morio vars import ~/morio_vars.json
+  morio vars export --only-custom | ssh other-host morio vars import -
+  morio vars import --replace --prefix NGINX_ ~/nginx.env`,
+	Use:   "import [file_path]",
+	Short: "Import vars from a JSON, YAML, or dotenv file",
+	Long: `Imports vars from a JSON, YAML, or dotenv file.
+Use - as the file path to read from stdin.
+
+The format is derived from the file extension (.json, .yaml, .yml, .env),
+and defaults to JSON. Use --format to set it explicitly.
+Run 'morio vars export' to see the structure.
+
+Use --prefix to only import vars whose name starts with a prefix.
+Use --replace to also remove all custom vars that are not in the input,
+making the input the complete list of custom vars (within the prefix).`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// Read data from file
-		jsonData, err := os.ReadFile(args[0])
+		// Read data from file, or stdin
+		var data []byte
+		var err error
+		if args[0] == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(args[0])
+		}
 		if err != nil {
 			log.Fatalf("Failed to open file: %v", err)
 		}
 
-		// Parse the JSON data
-		var data map[string]string
-		err = json.Unmarshal(jsonData, &data)
+		// Parse the data
+		format := varsFormat
+		if !cmd.Flags().Changed("format") {
+			format = VarsFormatFromFile(args[0])
+		}
+		vars, err := DecodeVars(data, format)
 		if err != nil {
-			log.Fatalf("Failed to parse JSON: %v", err)
+			log.Fatalf("Failed to parse %s: %v", format, err)
 		}
+		vars = FilterVars(vars, varsPrefix)
 
 		// Iterate over the keys and values in the map
-		for key, value := range data {
-			SetVar(key, value)
+		for _, key := range sortedKeys(vars) {
+			if err := ChangeVar("import", key, vars[key]); err != nil {
+				log.Fatalf("Failed to import %s: %v", key, err)
+			}
+		}
+		if importReplace {
+			for key := range FilterVars(GetCustomVars(), varsPrefix) {
+				if _, ok := vars[key]; !ok {
+					if err := RemoveVar("import", key); err != nil {
+						log.Fatalf("Failed to remove %s: %v", key, err)
+					}
+				}
+			}
+		}
+	},
+}
+
+// morio vars remove
+var removeCmd = &cobra.Command{
+	Use:   "remove NAME item",
+	Short: "Remove an item from a list var",
+	Long: `Removes an item from a template variable (var) that holds a list.
+This will always write a custom template variable.
+To remove the var itself, use 'morio vars rm'.`,
+	Args:    cobra.ExactArgs(2),
+	Example: "  morio vars remove NGINX_LOG_PATHS /srv/logs/nginx",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := RemoveVarItem(args[0], args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
 	},
 }
@@ -135,7 +261,10 @@ If you want the variable gone altogether, use 'morio vars clear' to
 set the var to an empty string. Note that you cannot remove default variables,
 but you can override them.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		RmVar(args[0])
+		if err := RemoveVar("rm", args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -144,23 +273,44 @@ var setCmd = &cobra.Command{
 	Use:   "set NAME value",
 	Short: "Set the value of a var",
 	Long: `Stores a new value for a template variable,
-This will always write a custom template variable.`,
-	Example: "  morio vars set WARP_DRIVE 9",
+This will always write a custom template variable.
+The value can reference other vars as ${NAME}.`,
+	Example: `  morio vars set WARP_DRIVE 9
+  morio vars set MORIO_BROKER_URL 'https://${MORIO_BROKER_HOST}:9092'`,
 	Run: func(cmd *cobra.Command, args []string) {
-		SetVar(args[0], args[1])
+		if err := ChangeVar("set", args[0], args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	},
 }
 
+var varsFormat string
+var varsPrefix string
+var exportOnlyCustom bool
+var importReplace bool
+
 func init() {
 	RootCmd.AddCommand(varsCmd)
+	varsCmd.AddCommand(addCmd)
 	varsCmd.AddCommand(clearCmd)
 	varsCmd.AddCommand(disableCmd)
 	varsCmd.AddCommand(enableCmd)
+	varsCmd.AddCommand(explainCmd)
 	varsCmd.AddCommand(exportCmd)
 	varsCmd.AddCommand(getCmd)
 	varsCmd.AddCommand(importCmd)
+	varsCmd.AddCommand(removeCmd)
 	varsCmd.AddCommand(rmCmd)
 	varsCmd.AddCommand(setCmd)
+
+	// Flags
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		cmd.Flags().StringVar(&varsFormat, "format", "json", "The format to use: json, yaml, or env")
+		cmd.Flags().StringVar(&varsPrefix, "prefix", "", "Only include vars whose name starts with this prefix")
+	}
+	exportCmd.Flags().BoolVar(&exportOnlyCustom, "only-custom", false, "Only export custom vars, not defaults")
+	importCmd.Flags().BoolVar(&importReplace, "replace", false, "Remove custom vars that are not in the input")
 }
 
 // Location of the variables files
@@ -199,15 +349,15 @@ func GetVars() map[string]string {
 	customs, err := ioutil.ReadDir(CustomVarFolder)
 	check(err)
 
-	// Iterate over the files
+	// Iterate over the files, hidden files (like .gitkeep) are not vars
 	for _, file := range defaults {
-		if !file.IsDir() {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
 			name := file.Name()
 			found[name] = GetVar(name)
 		}
 	}
 	for _, file := range customs {
-		if !file.IsDir() {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
 			name := file.Name()
 			found[name] = GetVar(name)
 		}
@@ -216,19 +366,44 @@ func GetVars() map[string]string {
 	return found
 }
 
+// Read the value of all custom variables
+// Hidden files (like .gitkeep) are not vars, and are skipped.
+func GetCustomVars() map[string]string {
+	found := make(map[string]string)
+	customs, err := ioutil.ReadDir(CustomVarFolder)
+	check(err)
+	for _, file := range customs {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			value, err := os.ReadFile(CustomVarFolder + "/" + file.Name())
+			check(err)
+			found[file.Name()] = string(value)
+		}
+	}
+
+	return found
+}
+
 // Write a value to a variable
-func SetVar(key string, value string) {
+// Facts are read-only, so they cannot be written.
+func SetVar(key string, value string) error {
+	if err := checkVarName(key); err != nil {
+		return err
+	}
+
 	// Open file
 	file, err := os.Create(CustomVarFolder + "/" + key)
-	check(err)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
 	// Write value
-	_, err = file.WriteString(value)
-	check(err)
+	if _, err = file.WriteString(value); err != nil {
+		return err
+	}
 
 	// Sync
-	file.Sync()
+	return file.Sync()
 }
 
 // Write a value to a default variable
@@ -247,11 +422,197 @@ func SetDefaultVar(key string, value string) {
 }
 
 // Remove a (custom) variable
-func RmVar(key string) {
+// Facts are read-only, so they cannot be removed.
+func RmVar(key string) error {
+	if err := checkVarName(key); err != nil {
+		return err
+	}
+
 	// Remove file
 	err := os.Remove(CustomVarFolder + "/" + key)
 	// Swallow errors if the file does not exist
 	if err != nil && !strings.Contains(err.Error(), "no such file or directory") {
-		check(err)
+		return err
+	}
+
+	return nil
+}
+
+// Vars are stored as strings, whatever type they were declared as
+// Lists and maps are stored as JSON.
+func stringifyVarValue(value interface{}) string {
+	switch v := value.(type) {
+	case []interface{}, map[string]interface{}:
+		data, err := json.Marshal(v)
+		if err == nil {
+			return string(data)
+		}
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// A value for a var, and where it came from
+type VarValue struct {
+	Layer  string // custom, default, template, or global
+	Origin string // the file holding the value
+	Value  string
+}
+
+// Returns all values of a var, starting with the one that takes precedence
+// Only the defaults of the templates that are passed in are considered.
+func VarLayers(key string, templates []string) []VarValue {
+	var layers []VarValue
+	if value, err := os.ReadFile(CustomVarFolder + "/" + key); err == nil {
+		layers = append(layers, VarValue{"custom", CustomVarFolder + "/" + key, string(value)})
+	}
+	if value, err := os.ReadFile(DefaultVarFolder + "/" + key); err == nil {
+		layers = append(layers, VarValue{"default", DefaultVarFolder + "/" + key, string(value)})
 	}
+	for _, template := range templates {
+		if value, ok := ExtractTemplateDefaultVars(template)[key]; ok {
+			layers = append(layers, VarValue{"template", TemplatePath(template), value})
+		}
+	}
+	if entry, ok := LoadGlobalVars()[key].(map[string]interface{}); ok {
+		if value, ok := entry["default"]; ok {
+			layers = append(layers, VarValue{"global", GetConfigPath("global-vars.yaml"), stringifyVarValue(value)})
+		}
+	}
+
+	return layers
+}
+
+// Describes where the effective value of a var comes from
+// Default vars are written by 'morio template' based on the template
+// defaults and global vars, so we look for where they came from.
+func VarSource(layers []VarValue) string {
+	if len(layers) == 0 {
+		return "unset"
+	}
+	effective := layers[0]
+	switch effective.Layer {
+	case "custom":
+		return "custom (" + effective.Origin + ")"
+	case "default":
+		for _, layer := range layers[1:] {
+			if layer.Value == effective.Value {
+				return VarSource([]VarValue{layer})
+			}
+		}
+		return "default (" + effective.Origin + ")"
+	case "template":
+		return "template default (" + effective.Origin + ")"
+	}
+
+	return "global (" + effective.Origin + ")"
+}
+
+// Prints the value, provenance, description, and users of a var
+func ExplainVar(key string) {
+	templates := AllTemplateFiles()
+	layers := VarLayers(key, templates)
+
+	fmt.Println("Name:   " + key)
+	if isFact(key) {
+		fmt.Printf("Value:  %q\n", HostFacts()[key])
+		fmt.Println("Source: host fact (read-only, run 'morio facts' to see all facts)")
+		return
+	}
+	if len(layers) == 0 {
+		fmt.Println("Value:  (not set)")
+	} else {
+		fmt.Printf("Value:  %q\n", layers[0].Value)
+		if varReference.MatchString(layers[0].Value) {
+			context, err := GetContext()
+			var warnings []string
+			if err == nil {
+				context, warnings, err = ResolveVars(context, []string{key})
+			}
+			if err != nil {
+				fmt.Println("        (unable to resolve: " + err.Error() + ")")
+			} else {
+				fmt.Printf("        (resolves to %q)\n", context[key])
+			}
+			for _, warning := range warnings {
+				fmt.Println("        (" + warning + ")")
+			}
+		}
+	}
+	fmt.Println("Source: " + VarSource(layers))
+
+	if about := VarAbout(key, templates); about != "" {
+		fmt.Println("\nAbout:")
+		for _, line := range strings.Split(about, "\n") {
+			fmt.Println("  " + line)
+		}
+	}
+
+	if len(layers) > 0 {
+		fmt.Println("\nValues (highest precedence first):")
+		for i, layer := range layers {
+			marker := "  "
+			note := ""
+			if i == 0 {
+				marker = "* "
+			} else if layer.Value != layers[0].Value {
+				note = " (shadowed)"
+			}
+			fmt.Printf("  %s%-9s %-20q %s%s\n", marker, layer.Layer, layer.Value, layer.Origin, note)
+		}
+	}
+
+	fmt.Println("\nUsed by:")
+	used := false
+	for _, template := range templates {
+		for _, name := range TemplateVarNames(template) {
+			if name != key {
+				continue
+			}
+			used = true
+			status := "enabled"
+			if filepath.Ext(template) == ".disabled" {
+				status = "disabled"
+			}
+			if strings.HasSuffix(template, ".mustache") {
+				fmt.Println("  - " + GetConfigPath(template) + " (" + strings.Split(template, "/")[0] + " agent configuration)")
+			} else {
+				fmt.Println("  - " + GetConfigPath(template) + " (module " + ModuleNameFromFile(template) + ", " + status + ")")
+			}
+		}
+	}
+	if !used {
+		fmt.Println("  No templates use this var")
+	}
+}
+
+// Returns the description of a var from global-vars.yaml or the templates
+func VarAbout(key string, templates []string) string {
+	if entry, ok := LoadGlobalVars()[key].(map[string]interface{}); ok {
+		if about, ok := entry["about"].(string); ok {
+			return strings.TrimSpace(about)
+		}
+	}
+	for _, template := range templates {
+		vars, _ := TemplateDocsAsYaml(template)["vars"].(map[string]interface{})
+		local, _ := vars["local"].(map[string]interface{})
+		switch declaration := local[key].(type) {
+		case string:
+			return strings.TrimSpace(declaration)
+		case map[string]interface{}:
+			if about, ok := declaration["about"].(string); ok {
+				return strings.TrimSpace(about)
+			}
+		}
+	}
+
+	return ""
 }